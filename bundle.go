@@ -0,0 +1,337 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * A bundle is a prebuilt, read-only index of a dependency (e.g. an SDK), so
+ * the projects using it do not need to index it from source. It is produced
+ * from the DB of the dependency's own tree:
+ *
+ *   $ navc export-bundle -db .navc_dbsymbols -root . -o sdk.navcb
+ *
+ * The bundle has the symbols of all the TUDBs merged by symbolID (the sha1 of
+ * the USR), with their declarations, definition and uses. Locations are
+ * relative to the root of the tree, so the bundle can be installed anywhere.
+ * The daemon loads bundles with -bundle file[=root], where root is where the
+ * sources of the dependency are, by default the directory of the bundle.
+ *
+ * Queries cross into the bundles when a symbol is not defined in the project:
+ * the definition and the uses of the symbol in the dependency are taken from
+ * the bundles. Locations inside the bundle sources are looked up in the bundles
+ * too, so navigation can continue there.
+ */
+
+import (
+	"encoding/gob"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// version of the bundle format. Increase it on any change to the serialized
+// structures.
+const bundleVersion string = "1"
+
+type bundleLoc struct {
+	File int32
+	Line int16
+	Col  int16
+}
+
+type bundleSymbol struct {
+	Name     string
+	Decls    []bundleLoc
+	DefAvail bool
+	Def      bundleLoc
+	Uses     []bundleLoc
+}
+
+type bundle struct {
+	Version string
+	Files   []string
+	Symbols map[symbolID]*bundleSymbol
+
+	// set when loaded
+	root    string
+	fileIdx map[string]int32
+	locs    map[bundleLoc]symbolID
+}
+
+///// Export
+
+// exportBundle merges the symbols of all the files in db under root.
+func exportBundle(db *symbolsDB, root string) (*bundle, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &bundle{
+		Version: bundleVersion,
+		Symbols: make(map[symbolID]*bundleSymbol),
+		locs:    make(map[bundleLoc]symbolID),
+	}
+
+	// index of every file in b.Files, -1 if it is out of the root
+	files := make(map[fileID]int32)
+	toBundleLoc := func(loc symbolLoc) (bundleLoc, bool) {
+		idx, exist := files[loc.File]
+		if !exist {
+			idx = -1
+			if cache := db.TUDBs[loc.File]; cache != nil {
+				abs, err := filepath.Abs(cache.Path)
+				if err == nil && isUnderDir(abs, absRoot) {
+					rel, _ := filepath.Rel(absRoot, abs)
+					idx = int32(len(b.Files))
+					b.Files = append(b.Files, filepath.ToSlash(rel))
+				}
+			}
+			files[loc.File] = idx
+		}
+
+		return bundleLoc{idx, loc.Line, loc.Col}, idx >= 0
+	}
+
+	// the same location is found in every TU including a header
+	addLoc := func(locs []bundleLoc, loc symbolLoc, id symbolID) []bundleLoc {
+		bloc, ok := toBundleLoc(loc)
+		if !ok {
+			return locs
+		}
+		if _, dup := b.locs[bloc]; dup {
+			return locs
+		}
+		b.locs[bloc] = id
+		return append(locs, bloc)
+	}
+
+	err = db.forEachTUDB(func(tudb *symbolsTUDB) error {
+		for id, data := range tudb.SymData {
+			sym := b.Symbols[id]
+			if sym == nil {
+				sym = &bundleSymbol{Name: data.Name}
+			}
+
+			for _, decl := range data.Decls {
+				sym.Decls = addLoc(sym.Decls, decl, id)
+			}
+			if data.DefAvail && !sym.DefAvail {
+				if def, ok := toBundleLoc(data.Def); ok {
+					sym.DefAvail = true
+					sym.Def = def
+				}
+			}
+			for _, use := range data.Uses {
+				sym.Uses = addLoc(sym.Uses, use.Loc, id)
+			}
+
+			if sym.DefAvail || len(sym.Decls) > 0 || len(sym.Uses) > 0 {
+				b.Symbols[id] = sym
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *bundle) save(path string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := gob.NewEncoder(f)
+
+	return enc.Encode(b)
+}
+
+// exportBundleCmd is the export-bundle command.
+func exportBundleCmd(args []string) error {
+	fs := flag.NewFlagSet("export-bundle", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	root := fs.String("root", ".",
+		"Root of the indexed tree, bundle locations are relative to it")
+	out := fs.String("o", "navc.bundle", "Path of the bundle to write")
+	fs.Parse(args)
+
+	db, err := openSymbolsDB(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	b, err := exportBundle(db, *root)
+	if err != nil {
+		return err
+	}
+	log.Println("exported", len(b.Symbols), "symbols in", len(b.Files),
+		"files to", *out)
+
+	return b.save(*out)
+}
+
+///// Load and queries
+
+// loadBundle reads a bundle given as file[=root].
+func loadBundle(spec string) (*bundle, error) {
+	path := spec
+	root := ""
+	if i := strings.LastIndex(spec, "="); i >= 0 {
+		path = spec[:i]
+		root = spec[i+1:]
+	}
+	if root == "" {
+		root = filepath.Dir(path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var b bundle
+	dec := gob.NewDecoder(f)
+	err = dec.Decode(&b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if b.Version != bundleVersion {
+		return nil, fmt.Errorf("%s: unsupported bundle version %s", path,
+			b.Version)
+	}
+
+	b.root = filepath.Clean(root)
+	b.fileIdx = make(map[string]int32)
+	for i, file := range b.Files {
+		b.fileIdx[file] = int32(i)
+	}
+	b.locs = make(map[bundleLoc]symbolID)
+	for id, sym := range b.Symbols {
+		for _, loc := range sym.Decls {
+			b.locs[loc] = id
+		}
+		for _, loc := range sym.Uses {
+			b.locs[loc] = id
+		}
+		if sym.DefAvail {
+			b.locs[sym.Def] = id
+		}
+	}
+
+	return &b, nil
+}
+
+// AddBundle adds a bundle to look up the symbols not defined in the project.
+func (db *symbolsDB) AddBundle(b *bundle) {
+	db.bundles = append(db.bundles, b)
+}
+
+func (b *bundle) getSymbolLocReq(locs []bundleLoc) []*SymbolLocReq {
+	res := []*SymbolLocReq{}
+	for _, loc := range locs {
+		res = append(res, &SymbolLocReq{
+			File: filepath.Join(b.root, filepath.FromSlash(b.Files[loc.File])),
+			Line: int(loc.Line),
+			Col:  int(loc.Col),
+		})
+	}
+
+	return res
+}
+
+// lookup returns the symbol at loc if it is in the bundle sources.
+func (b *bundle) lookup(loc *SymbolLocReq) (symbolID, bool) {
+	rel, err := filepath.Rel(b.root, filepath.Clean(loc.File))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		absRoot, err1 := filepath.Abs(b.root)
+		absFile, err2 := filepath.Abs(loc.File)
+		if err1 != nil || err2 != nil {
+			return symbolID{}, false
+		}
+		rel, err = filepath.Rel(absRoot, absFile)
+		if err != nil {
+			return symbolID{}, false
+		}
+	}
+
+	idx, exist := b.fileIdx[filepath.ToSlash(rel)]
+	if !exist {
+		return symbolID{}, false
+	}
+
+	id, exist := b.locs[bundleLoc{idx, int16(loc.Line), int16(loc.Col)}]
+	return id, exist
+}
+
+func (db *symbolsDB) bundleLookup(loc *SymbolLocReq) (symbolID, bool) {
+	for _, b := range db.bundles {
+		if id, exist := b.lookup(loc); exist {
+			return id, true
+		}
+	}
+
+	return symbolID{}, false
+}
+
+func (db *symbolsDB) bundleDecls(id symbolID) []*SymbolLocReq {
+	res := []*SymbolLocReq{}
+	for _, b := range db.bundles {
+		if sym := b.Symbols[id]; sym != nil {
+			res = append(res, b.getSymbolLocReq(sym.Decls)...)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+
+	return res
+}
+
+func (db *symbolsDB) bundleDef(id symbolID) *SymbolLocReq {
+	for _, b := range db.bundles {
+		if sym := b.Symbols[id]; sym != nil && sym.DefAvail {
+			return b.getSymbolLocReq([]bundleLoc{sym.Def})[0]
+		}
+	}
+
+	return nil
+}
+
+func (db *symbolsDB) bundleUses(id symbolID) []*SymbolLocReq {
+	res := []*SymbolLocReq{}
+	for _, b := range db.bundles {
+		if sym := b.Symbols[id]; sym != nil {
+			res = append(res, b.getSymbolLocReq(sym.Uses)...)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+
+	return res
+}
@@ -0,0 +1,506 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * The export command writes the symbols DB as a precise code intelligence dump
+ * for code search platforms:
+ *
+ *   $ navc export -format lsif -o dump.lsif
+ *   $ navc export -format scip -o index.scip
+ *
+ * - lsif: LSIF 0.4.3, a graph of JSON vertices and edges, one per line. Every
+ *   symbol is a resultSet with its moniker, hover, definition result and
+ *   reference result, and every location is a range pointing to it.
+ *
+ * - scip: a SCIP Index protobuf message. There are no generated protobuf
+ *   bindings in navc, the few messages needed are encoded by hand.
+ *
+ * Only the documents under the project root (-root) are exported. Monikers and
+ * SCIP symbols are derived from the symbolID, which is the sha1 of the USR, so
+ * the same symbol has the same moniker in all the TUs and projects. Symbols
+ * with internal linkage and local variables get local monikers. The hover text
+ * is the source line of the definition, the only signature kept in the DB.
+ */
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const lsifVersion string = "0.4.3"
+
+// symbol roles of the SCIP occurrences
+const scipRoleDefinition int = 1
+
+type intelOcc struct {
+	sym *globalSymbol
+	loc symbolLoc
+	def bool
+}
+
+type intelDump struct {
+	gi   *globalIndex
+	root string
+
+	// documents relative to root, sorted, and their occurrences
+	docs  []string
+	occs  map[string][]intelOcc
+	paths map[string]string
+
+	// first line of the definition of every symbol
+	hovers map[symbolID]string
+}
+
+func newIntelDump(gi *globalIndex, root string) (*intelDump, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &intelDump{
+		gi:     gi,
+		root:   absRoot,
+		occs:   make(map[string][]intelOcc),
+		paths:  make(map[string]string),
+		hovers: make(map[symbolID]string),
+	}
+
+	// relative path of every file under the root
+	rels := make(map[fileID]string)
+	relPath := func(fid fileID) string {
+		rel, exist := rels[fid]
+		if !exist {
+			path := gi.path(fid)
+			abs, err := filepath.Abs(path)
+			if path != "" && err == nil && isUnderDir(abs, absRoot) {
+				rel, _ = filepath.Rel(absRoot, abs)
+				rel = filepath.ToSlash(rel)
+				dump.paths[rel] = path
+			}
+			rels[fid] = rel
+		}
+		return rel
+	}
+	add := func(sym *globalSymbol, loc symbolLoc, def bool) {
+		if rel := relPath(loc.File); rel != "" {
+			dump.occs[rel] = append(dump.occs[rel], intelOcc{sym, loc, def})
+		}
+	}
+
+	for _, sym := range gi.symbols {
+		if sym.Name == "" {
+			continue
+		}
+
+		defFound := false
+		for _, decl := range sym.Decls {
+			isDef := sym.DefAvail && decl == sym.Def
+			defFound = defFound || isDef
+			add(sym, decl, isDef)
+		}
+		if sym.DefAvail && !defFound {
+			add(sym, sym.Def, true)
+		}
+		for _, use := range sym.Uses {
+			add(sym, use.Loc, false)
+		}
+	}
+
+	for doc, occs := range dump.occs {
+		dump.docs = append(dump.docs, doc)
+		sort.Slice(occs, func(i, j int) bool {
+			if occs[i].loc.Line != occs[j].loc.Line {
+				return occs[i].loc.Line < occs[j].loc.Line
+			}
+			return occs[i].loc.Col < occs[j].loc.Col
+		})
+	}
+	sort.Strings(dump.docs)
+
+	dump.readHovers()
+
+	return dump, nil
+}
+
+// readHovers reads the definition line of the symbols, one file at a time.
+func (dump *intelDump) readHovers() {
+	for _, doc := range dump.docs {
+		content, err := ioutil.ReadFile(dump.paths[doc])
+		if err != nil {
+			continue
+		}
+		lines := strings.Split(string(content), "\n")
+
+		for _, occ := range dump.occs[doc] {
+			line := int(occ.loc.Line)
+			if !occ.def || line < 1 || line > len(lines) {
+				continue
+			}
+			dump.hovers[occ.sym.ID] = strings.TrimSpace(lines[line-1])
+		}
+	}
+}
+
+func (dump *intelDump) isLocal(sym *globalSymbol) bool {
+	return sym.Static || sym.Kind == "local" || sym.Kind == "parameter"
+}
+
+// moniker returns the identifier of a symbol, derived from its USR.
+func (dump *intelDump) moniker(sym *globalSymbol) string {
+	return hex.EncodeToString(sym.ID[:])
+}
+
+///// LSIF
+
+type lsifWriter struct {
+	w      *bufio.Writer
+	nextID int
+	err    error
+}
+
+type lsifPos struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+func (lw *lsifWriter) emit(elem map[string]interface{}) int {
+	lw.nextID++
+	elem["id"] = lw.nextID
+
+	data, err := json.Marshal(elem)
+	if err != nil && lw.err == nil {
+		lw.err = err
+	}
+	lw.w.Write(data)
+	lw.w.WriteByte('\n')
+
+	return lw.nextID
+}
+
+func (lw *lsifWriter) vertex(label string, props map[string]interface{}) int {
+	if props == nil {
+		props = map[string]interface{}{}
+	}
+	props["type"] = "vertex"
+	props["label"] = label
+
+	return lw.emit(props)
+}
+
+func (lw *lsifWriter) edge(label string, outV int, inVs []int, props map[string]interface{}) {
+	if props == nil {
+		props = map[string]interface{}{}
+	}
+	props["type"] = "edge"
+	props["label"] = label
+	props["outV"] = outV
+	if len(inVs) == 1 && label != "contains" && label != "item" {
+		props["inV"] = inVs[0]
+	} else {
+		props["inVs"] = inVs
+	}
+
+	lw.emit(props)
+}
+
+func (dump *intelDump) writeLSIF(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lw := &lsifWriter{w: bufio.NewWriter(f)}
+
+	lw.vertex("metaData", map[string]interface{}{
+		"version":          lsifVersion,
+		"projectRoot":      "file://" + filepath.ToSlash(dump.root),
+		"positionEncoding": "utf-16",
+		"toolInfo":         map[string]string{"name": "navc"},
+	})
+	project := lw.vertex("project", map[string]interface{}{"kind": "c"})
+
+	// ranges of every symbol, by document, to fill the results
+	type symRanges struct {
+		all  []int
+		defs map[int][]int
+		refs map[int][]int
+	}
+	symbols := map[symbolID]*symRanges{}
+	syms := []*globalSymbol{}
+
+	docIDs := []int{}
+	for _, doc := range dump.docs {
+		uri := "file://" + filepath.ToSlash(filepath.Join(dump.root, doc))
+		docID := lw.vertex("document", map[string]interface{}{
+			"uri":        uri,
+			"languageId": "c",
+		})
+		docIDs = append(docIDs, docID)
+
+		ranges := []int{}
+		for _, occ := range dump.occs[doc] {
+			line := int(occ.loc.Line) - 1
+			col := int(occ.loc.Col) - 1
+			rangeID := lw.vertex("range", map[string]interface{}{
+				"start": lsifPos{line, col},
+				"end":   lsifPos{line, col + len(occ.sym.Name)},
+			})
+			ranges = append(ranges, rangeID)
+
+			sr := symbols[occ.sym.ID]
+			if sr == nil {
+				sr = &symRanges{
+					defs: make(map[int][]int),
+					refs: make(map[int][]int),
+				}
+				symbols[occ.sym.ID] = sr
+				syms = append(syms, occ.sym)
+			}
+			sr.all = append(sr.all, rangeID)
+			if occ.def {
+				sr.defs[docID] = append(sr.defs[docID], rangeID)
+			} else {
+				sr.refs[docID] = append(sr.refs[docID], rangeID)
+			}
+		}
+		if len(ranges) > 0 {
+			lw.edge("contains", docID, ranges, nil)
+		}
+	}
+	if len(docIDs) > 0 {
+		lw.edge("contains", project, docIDs, nil)
+	}
+
+	sortedDocs := func(byDoc map[int][]int) []int {
+		docs := []int{}
+		for doc := range byDoc {
+			docs = append(docs, doc)
+		}
+		sort.Ints(docs)
+		return docs
+	}
+
+	for _, sym := range syms {
+		sr := symbols[sym.ID]
+		resultSet := lw.vertex("resultSet", nil)
+		for _, rangeID := range sr.all {
+			lw.edge("next", rangeID, []int{resultSet}, nil)
+		}
+
+		kind := "export"
+		if dump.isLocal(sym) {
+			kind = "local"
+		}
+		moniker := lw.vertex("moniker", map[string]interface{}{
+			"scheme":     "navc",
+			"identifier": dump.moniker(sym),
+			"kind":       kind,
+		})
+		lw.edge("moniker", resultSet, []int{moniker}, nil)
+
+		if hover, exist := dump.hovers[sym.ID]; exist {
+			hoverID := lw.vertex("hoverResult", map[string]interface{}{
+				"result": map[string]interface{}{
+					"contents": map[string]string{
+						"kind":  "markdown",
+						"value": "```c\n" + hover + "\n```",
+					},
+				},
+			})
+			lw.edge("textDocument/hover", resultSet, []int{hoverID}, nil)
+		}
+
+		if len(sr.defs) > 0 {
+			defResult := lw.vertex("definitionResult", nil)
+			lw.edge("textDocument/definition", resultSet, []int{defResult}, nil)
+			for _, doc := range sortedDocs(sr.defs) {
+				lw.edge("item", defResult, sr.defs[doc],
+					map[string]interface{}{"document": doc})
+			}
+		}
+
+		refResult := lw.vertex("referenceResult", nil)
+		lw.edge("textDocument/references", resultSet, []int{refResult}, nil)
+		for _, doc := range sortedDocs(sr.defs) {
+			lw.edge("item", refResult, sr.defs[doc], map[string]interface{}{
+				"document": doc,
+				"property": "definitions",
+			})
+		}
+		for _, doc := range sortedDocs(sr.refs) {
+			lw.edge("item", refResult, sr.refs[doc], map[string]interface{}{
+				"document": doc,
+				"property": "references",
+			})
+		}
+	}
+
+	if lw.err != nil {
+		return lw.err
+	}
+
+	return lw.w.Flush()
+}
+
+///// SCIP
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+
+	return append(buf, byte(v))
+}
+
+// appendField appends a length delimited field (strings and messages).
+func appendField(buf []byte, field int, data []byte) []byte {
+	buf = appendVarint(buf, uint64(field<<3|2))
+	buf = appendVarint(buf, uint64(len(data)))
+
+	return append(buf, data...)
+}
+
+func appendIntField(buf []byte, field int, v int) []byte {
+	if v == 0 {
+		return buf
+	}
+	buf = appendVarint(buf, uint64(field<<3))
+
+	return appendVarint(buf, uint64(v))
+}
+
+func appendPackedInts(buf []byte, field int, vs []int) []byte {
+	packed := []byte{}
+	for _, v := range vs {
+		packed = appendVarint(packed, uint64(v))
+	}
+
+	return appendField(buf, field, packed)
+}
+
+// scipSymbol returns the SCIP symbol of a navc symbol: a local symbol, or a
+// global one in the navc scheme with the symbolID as namespace.
+func (dump *intelDump) scipSymbol(sym *globalSymbol) string {
+	if dump.isLocal(sym) {
+		return "local " + dump.moniker(sym)
+	}
+
+	suffix := "."
+	switch sym.Kind {
+	case "function":
+		suffix = "()."
+	case "struct", "union", "enum", "typedef":
+		suffix = "#"
+	case "macro":
+		suffix = "!"
+	}
+
+	return "navc . . . " + dump.moniker(sym) + "/" + sym.Name + suffix
+}
+
+func (dump *intelDump) scipDocument(doc string) []byte {
+	buf := []byte{}
+	buf = appendField(buf, 1, []byte(doc))
+
+	defined := []*globalSymbol{}
+	for _, occ := range dump.occs[doc] {
+		line := int(occ.loc.Line) - 1
+		col := int(occ.loc.Col) - 1
+
+		occBuf := appendPackedInts(nil, 1,
+			[]int{line, col, col + len(occ.sym.Name)})
+		occBuf = appendField(occBuf, 2, []byte(dump.scipSymbol(occ.sym)))
+		if occ.def {
+			occBuf = appendIntField(occBuf, 3, scipRoleDefinition)
+			defined = append(defined, occ.sym)
+		}
+		buf = appendField(buf, 2, occBuf)
+	}
+
+	for _, sym := range defined {
+		info := appendField(nil, 1, []byte(dump.scipSymbol(sym)))
+		if hover, exist := dump.hovers[sym.ID]; exist {
+			info = appendField(info, 3, []byte("```c\n"+hover+"\n```"))
+		}
+		info = appendField(info, 6, []byte(sym.Name))
+		buf = appendField(buf, 3, info)
+	}
+
+	return appendField(buf, 4, []byte("c"))
+}
+
+func (dump *intelDump) writeSCIP(path string) error {
+	toolInfo := appendField(nil, 1, []byte("navc"))
+	metadata := appendField(nil, 2, toolInfo)
+	metadata = appendField(metadata, 3,
+		[]byte("file://"+filepath.ToSlash(dump.root)))
+	// UTF8 encoding
+	metadata = appendIntField(metadata, 4, 1)
+
+	index := appendField(nil, 1, metadata)
+	for _, doc := range dump.docs {
+		index = appendField(index, 2, dump.scipDocument(doc))
+	}
+
+	return ioutil.WriteFile(path, index, 0644)
+}
+
+// exportCmd is the export command.
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	format := fs.String("format", "lsif", "Dump format: lsif or scip")
+	root := fs.String("root", ".", "Project root, only files under it are exported")
+	out := fs.String("o", "", "Path of the dump (default dump.lsif or index.scip)")
+	fs.Parse(args)
+
+	gi, err := openGlobalIndex(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	dump, err := newIntelDump(gi, *root)
+	if err != nil {
+		return err
+	}
+
+	switch *format {
+	case "lsif":
+		if *out == "" {
+			*out = "dump.lsif"
+		}
+		return dump.writeLSIF(*out)
+	case "scip":
+		if *out == "" {
+			*out = "index.scip"
+		}
+		return dump.writeSCIP(*out)
+	}
+
+	return fmt.Errorf("unknown export format %q", *format)
+}
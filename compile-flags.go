@@ -0,0 +1,159 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Projects without compile_commands.json can give the compilation arguments in
+ * flag files, with one argument per line:
+ *
+ * - compile_flags.txt: clang's format. It applies to all the files in its
+ *   directory and subdirectories. Only the closest one to the file is used.
+ *
+ * - .navcflags: navc's format. It also applies to all the files under its
+ *   directory, but all of them between the file and the index directory are
+ *   merged, outermost first. For instance, a sub-library can add its own -I
+ *   options to the ones of the project.
+ *
+ * The arguments of compile_commands.json take precedence over the flag files.
+ * Flag files are read lazily and cached per directory. When one changes, the
+ * directory is invalidated (InvalidateFlagDir) and the files under it are
+ * parsed again.
+ */
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const compileFlagsFile string = "compile_flags.txt"
+const navcFlagsFile string = ".navcflags"
+
+type dirFlags struct {
+	compileFlags []string
+	navcFlags    []string
+}
+
+func isFlagFile(path string) bool {
+	base := filepath.Base(path)
+	return base == compileFlagsFile || base == navcFlagsFile
+}
+
+// readFlagFile returns the arguments in a flag file, or nil if it does not
+// exist. Relative include directories are relative to the file directory.
+func readFlagFile(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	return getCompArgs(strings.Join(lines, " "), filepath.Dir(path))
+}
+
+func (cdb *compileDB) getDirFlags(dir string) *dirFlags {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	flags := cdb.flagDirs[dir]
+	if flags == nil {
+		flags = &dirFlags{
+			compileFlags: readFlagFile(filepath.Join(dir, compileFlagsFile)),
+			navcFlags:    readFlagFile(filepath.Join(dir, navcFlagsFile)),
+		}
+		cdb.flagDirs[dir] = flags
+	}
+
+	return flags
+}
+
+// isInputDir checks if dir is one of the index directories, where we stop
+// looking for flag files.
+func (cdb *compileDB) isInputDir(dir string) bool {
+	for _, input := range cdb.inputDirs {
+		if filepath.Clean(input) == dir {
+			return true
+		}
+	}
+
+	return false
+}
+
+// flagFilesArgs returns the arguments for file from the flag files and their
+// description, or an empty description if there are no flag files.
+func (cdb *compileDB) flagFilesArgs(file string) ([]string, string) {
+	var compileFlags []string
+	compileFlagsDir := ""
+	navcDirs := []string{}
+	navcFlags := [][]string{}
+
+	dir := filepath.Dir(file)
+	for {
+		flags := cdb.getDirFlags(dir)
+		if compileFlags == nil && flags.compileFlags != nil {
+			compileFlags = flags.compileFlags
+			compileFlagsDir = dir
+		}
+		if flags.navcFlags != nil {
+			navcDirs = append(navcDirs, dir)
+			navcFlags = append(navcFlags, flags.navcFlags)
+		}
+
+		parent := filepath.Dir(dir)
+		if cdb.isInputDir(dir) || parent == dir {
+			break
+		}
+		dir = parent
+	}
+
+	if compileFlags == nil && len(navcFlags) == 0 {
+		return nil, ""
+	}
+
+	args := []string{}
+	sources := []string{}
+	if compileFlags != nil {
+		args = append(args, compileFlags...)
+		sources = append(sources,
+			filepath.Join(compileFlagsDir, compileFlagsFile))
+	}
+	for i := len(navcFlags) - 1; i >= 0; i-- {
+		args = append(args, navcFlags[i]...)
+		sources = append(sources, filepath.Join(navcDirs[i], navcFlagsFile))
+	}
+
+	return args, strings.Join(sources, ", ")
+}
+
+// InvalidateFlagDir forgets the flag files read in dir.
+func (cdb *compileDB) InvalidateFlagDir(dir string) {
+	cdb.Lock()
+	defer cdb.Unlock()
+
+	delete(cdb.flagDirs, dir)
+}
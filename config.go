@@ -0,0 +1,304 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * The daemon settings come from three places, in order of precedence (lowest
+ * first): the defaults (defaultConfig), the project configuration file
+ * (.navc.json in the directory where navc is started), and the command line
+ * flags. Only the flags explicitly given override the configuration file.
+ *
+ * The configuration file is a JSON object with any of the fields of the config
+ * struct, e.g.:
+ *
+ *   {
+ *     "IndexDirs": ["src", "include"],
+ *     "Exclude": ["third_party/"],
+ *     "FlushInterval": "30s",
+ *     "CacheMemory": 512
+ *   }
+ *
+ * The file is watched, and reloaded on change (reloadConfig). Only the settings
+ * that can be safely changed on a running daemon are applied (see
+ * applyConfig in files.go); the rest require a restart.
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const defaultConfigFile string = ".navc.json"
+
+// configDuration is a time.Duration read from JSON as a string, e.g. "10s".
+type configDuration time.Duration
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = configDuration(duration)
+
+	return nil
+}
+
+type config struct {
+	// index roots and files
+	IndexDirs   []string
+	CExtensions []string
+	HExtensions []string
+	SysInclDirs []string
+	BuildDriven bool
+
+	// system and third-party headers (see external.go)
+	IndexExternal bool
+	ExternalCache string
+
+	// tags file kept updated by the daemon (see tags.go)
+	TagsFile   string
+	TagsFormat string
+
+	// prebuilt indexes of dependencies, as file[=root] (see bundle.go)
+	Bundles []string
+
+	// symbols never reported as dead code (see dead-code.go)
+	DeadCodeAllow      []string
+	DeadCodeAllowFiles []string
+
+	// ignore rules (see ignore.go)
+	Exclude   []string
+	Include   []string
+	GitIgnore bool
+
+	// daemon
+	DB            string
+	Socket        string
+	Threads       int
+	FlushInterval configDuration
+	CacheMemory   int64
+	QuietPeriod   configDuration
+	Watcher       string
+	PollInterval  configDuration
+}
+
+// configuration file and flags given in the command line, kept for reloading
+var configPath string
+var configFlags *config
+var configFlagsSet map[string]bool
+
+func defaultConfig() *config {
+	return &config{
+		IndexDirs:     []string{"."},
+		CExtensions:   []string{".c"},
+		HExtensions:   []string{".h"},
+		SysInclDirs:   []string{"/usr/include/", "/usr/lib/"},
+		ExternalCache: defaultExternalCache(),
+		TagsFormat:    "ctags",
+		DeadCodeAllow: []string{"main", ".*_H", ".*_H_"},
+		DB:            ".navc_dbsymbols",
+		Socket:        ".navc.sock",
+		Threads:       runtime.NumCPU(),
+		FlushInterval: configDuration(10 * time.Second),
+		QuietPeriod:   configDuration(200 * time.Millisecond),
+		Watcher:       "auto",
+		PollInterval:  configDuration(2 * time.Second),
+	}
+}
+
+// registerConfigFlags registers the command line flags that override the
+// configuration file. The values are stored in cfg.
+func registerConfigFlags(cfg *config) {
+	flag.StringVar(&cfg.DB, "db", cfg.DB, "Path to symbols DB dir")
+	flag.IntVar(&cfg.Threads, "numThreads", cfg.Threads,
+		"Number of indexing threads")
+	flag.StringVar(&cfg.Socket, "socket", cfg.Socket,
+		"Path of the socket to listen for requests")
+	flag.DurationVar((*time.Duration)(&cfg.FlushInterval), "flushInterval",
+		time.Duration(cfg.FlushInterval),
+		"Time between flushes of the symbols DB to disk")
+	flag.Int64Var(&cfg.CacheMemory, "cacheMem", cfg.CacheMemory,
+		"Memory budget in MB for loaded symbols DB files (0 = no limit)")
+	flag.DurationVar((*time.Duration)(&cfg.QuietPeriod), "quietPeriod",
+		time.Duration(cfg.QuietPeriod),
+		"Time a file has to be unchanged before reindexing it")
+	flag.StringVar(&cfg.Watcher, "watcher", cfg.Watcher,
+		"File watcher: auto, fsnotify, poll or hybrid")
+	flag.DurationVar((*time.Duration)(&cfg.PollInterval), "pollInterval",
+		time.Duration(cfg.PollInterval),
+		"Time between scans of the polling watcher")
+	flag.BoolVar(&cfg.GitIgnore, "gitignore", cfg.GitIgnore,
+		"Do not index files ignored by the .gitignore files of the index dirs")
+	flag.Var((*stringList)(&cfg.Exclude), "exclude",
+		"Pattern (gitignore syntax) of files not to index, can be repeated")
+	flag.Var((*stringList)(&cfg.Include), "include",
+		"Pattern of files to index even if excluded, can be repeated")
+	flag.BoolVar(&cfg.BuildDriven, "buildDriven", cfg.BuildDriven,
+		"Index only the files listed in compile_commands.json")
+	flag.Var((*stringList)(&cfg.SysInclDirs), "sysInclDir",
+		"Additional system or third-party include root, can be repeated")
+	flag.BoolVar(&cfg.IndexExternal, "indexExternal", cfg.IndexExternal,
+		"Index the headers under the system include roots in the user level cache")
+	flag.StringVar(&cfg.ExternalCache, "externalCache", cfg.ExternalCache,
+		"Path to the user level cache of system headers")
+	flag.StringVar(&cfg.TagsFile, "tagsFile", cfg.TagsFile,
+		"Path of a tags file to keep updated (default none)")
+	flag.StringVar(&cfg.TagsFormat, "tagsFormat", cfg.TagsFormat,
+		"Format of the tags file: ctags or etags")
+	flag.Var((*stringList)(&cfg.Bundles), "bundle",
+		"Prebuilt index of a dependency as file[=root], can be repeated")
+}
+
+// overrideConfig sets in cfg the values of the flags given in the command
+// line.
+func overrideConfig(cfg, flags *config, set map[string]bool) {
+	for name := range set {
+		switch name {
+		case "db":
+			cfg.DB = flags.DB
+		case "numThreads":
+			cfg.Threads = flags.Threads
+		case "socket":
+			cfg.Socket = flags.Socket
+		case "flushInterval":
+			cfg.FlushInterval = flags.FlushInterval
+		case "cacheMem":
+			cfg.CacheMemory = flags.CacheMemory
+		case "quietPeriod":
+			cfg.QuietPeriod = flags.QuietPeriod
+		case "watcher":
+			cfg.Watcher = flags.Watcher
+		case "pollInterval":
+			cfg.PollInterval = flags.PollInterval
+		case "gitignore":
+			cfg.GitIgnore = flags.GitIgnore
+		case "exclude":
+			cfg.Exclude = flags.Exclude
+		case "include":
+			cfg.Include = flags.Include
+		case "buildDriven":
+			cfg.BuildDriven = flags.BuildDriven
+		case "sysInclDir":
+			// the flag values are appended to the defaults
+			extra := flags.SysInclDirs[len(defaultConfig().SysInclDirs):]
+			cfg.SysInclDirs = append(cfg.SysInclDirs, extra...)
+		case "indexExternal":
+			cfg.IndexExternal = flags.IndexExternal
+		case "externalCache":
+			cfg.ExternalCache = flags.ExternalCache
+		case "tagsFile":
+			cfg.TagsFile = flags.TagsFile
+		case "tagsFormat":
+			cfg.TagsFormat = flags.TagsFormat
+		case "bundle":
+			cfg.Bundles = flags.Bundles
+		}
+	}
+
+	if len(flags.IndexDirs) > 0 {
+		cfg.IndexDirs = flags.IndexDirs
+	}
+}
+
+func normalizeExtensions(exts []string) []string {
+	ret := []string{}
+	for _, ext := range exts {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		ret = append(ret, ext)
+	}
+
+	return ret
+}
+
+// readConfig returns the configuration in path over the defaults. A missing
+// file is not an error.
+func readConfig(path string) (*config, error) {
+	cfg := defaultConfig()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	err = dec.Decode(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return cfg, nil
+}
+
+// loadConfig reads the configuration file and applies the command line flags.
+func loadConfig(path string, flags *config, set map[string]bool) (*config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	overrideConfig(cfg, flags, set)
+	cfg.CExtensions = normalizeExtensions(cfg.CExtensions)
+	cfg.HExtensions = normalizeExtensions(cfg.HExtensions)
+
+	configPath = filepath.Clean(path)
+	configFlags = flags
+	configFlagsSet = set
+
+	return cfg, nil
+}
+
+// reloadConfig reads again the configuration file given to loadConfig.
+func reloadConfig() (*config, error) {
+	return loadConfig(configPath, configFlags, configFlagsSet)
+}
+
+func isConfigFile(path string) bool {
+	return configPath != "" && filepath.Clean(path) == configPath
+}
+
+func hasExtension(path string, exts []string) bool {
+	base := filepath.Base(path)
+	if base[0] == '.' {
+		return false
+	}
+
+	ext := filepath.Ext(base)
+	for _, valid := range exts {
+		if ext == valid {
+			return true
+		}
+	}
+
+	return false
+}
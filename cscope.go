@@ -0,0 +1,553 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * The cscope command answers the cscope line-oriented interface (cscope -dl)
+ * from the symbols DB, so editor integrations of cscope get clang-accurate
+ * results:
+ *
+ *   $ navc cscope
+ *   >> 1main
+ *   cscope: 1 lines
+ *   src/main.c main 42 int main(int argc, char *argv[])
+ *
+ * Every query is a line with the query number followed by the pattern:
+ *
+ *   0 symbol, 1 global definition, 2 functions called by, 3 functions calling,
+ *   4 text string, 6 egrep pattern, 7 file, 8 files #including, 9 assignments.
+ *
+ * Query 5 (change text) is not supported. The result lines are "file function
+ * line text", where function is the enclosing function or <global>. Symbol
+ * patterns with regular expression metacharacters match the whole name.
+ *
+ * With -export, it writes instead a cscope.out database (uncompressed, as
+ * built by cscope -c) for the integrations that read it directly. Only the
+ * lines with indexed symbols are in it, as in cscope.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// version of the cscope.out format written
+const cscopeVersion int = 15
+
+type cscopeResult struct {
+	path string
+	fn   string
+	line int
+}
+
+type cscope struct {
+	gi *globalIndex
+
+	// lines of the files read, indexed by path
+	sources map[string][]string
+}
+
+func newCscope(gi *globalIndex) *cscope {
+	return &cscope{
+		gi:      gi,
+		sources: make(map[string][]string),
+	}
+}
+
+func (cs *cscope) sourceLines(path string) []string {
+	lines, exist := cs.sources[path]
+	if !exist {
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			lines = strings.Split(string(content), "\n")
+		}
+		cs.sources[path] = lines
+	}
+
+	return lines
+}
+
+func (cs *cscope) sourceLine(path string, line int) string {
+	lines := cs.sourceLines(path)
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.Replace(lines[line-1], "\t", " ", -1))
+}
+
+// result returns the result for loc, with its enclosing function.
+func (cs *cscope) result(loc symbolLoc) (cscopeResult, bool) {
+	path := cs.gi.path(loc.File)
+	if path == "" {
+		return cscopeResult{}, false
+	}
+
+	fn := "<global>"
+	if sym := cs.gi.enclosingFunc(loc); sym != nil {
+		fn = sym.Name
+	}
+
+	return cscopeResult{path, fn, int(loc.Line)}, true
+}
+
+func (cs *cscope) addResults(res []cscopeResult, locs ...symbolLoc) []cscopeResult {
+	for _, loc := range locs {
+		if r, ok := cs.result(loc); ok {
+			res = append(res, r)
+		}
+	}
+
+	return res
+}
+
+// findSymbol is query 0, all the declarations and uses of the symbol.
+func (cs *cscope) findSymbol(pattern string) ([]cscopeResult, error) {
+	syms, err := cs.gi.lookupName(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []cscopeResult{}
+	for _, sym := range syms {
+		res = cs.addResults(res, sym.Decls...)
+		for _, use := range sym.Uses {
+			res = cs.addResults(res, use.Loc)
+		}
+	}
+
+	return res, nil
+}
+
+// findDefinition is query 1, the definitions of the non local symbols.
+func (cs *cscope) findDefinition(pattern string) ([]cscopeResult, error) {
+	syms, err := cs.gi.lookupName(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []cscopeResult{}
+	for _, sym := range syms {
+		switch {
+		case sym.Kind == "local" || sym.Kind == "parameter":
+		case sym.DefAvail:
+			res = cs.addResults(res, sym.Def)
+		case sym.Kind == "variable":
+			res = cs.addResults(res, sym.Decls...)
+		}
+	}
+
+	return res, nil
+}
+
+// findCallees is query 2, the functions called by the function, with the
+// candidate targets of the calls through function pointers. The function
+// of the results is the callee.
+func (cs *cscope) findCallees(pattern string) ([]cscopeResult, error) {
+	syms, err := cs.gi.lookupName(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []cscopeResult{}
+	for _, sym := range syms {
+		fn := cs.gi.funcRangeOf(sym)
+		if fn == nil {
+			continue
+		}
+
+		for _, call := range cs.gi.calls {
+			if call.Loc.File != fn.Start.File ||
+				call.Loc.Line < fn.Start.Line || call.Loc.Line > fn.End {
+				continue
+			}
+			r, ok := cs.result(call.Loc)
+			if !ok {
+				continue
+			}
+			for _, callee := range cs.gi.callees(call) {
+				r.fn = callee.Name
+				res = append(res, r)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// findCallers is query 3, the calls to the function, including the ones through
+// the fields and variables it is stored into.
+func (cs *cscope) findCallers(pattern string) ([]cscopeResult, error) {
+	syms, err := cs.gi.lookupName(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []cscopeResult{}
+	for _, sym := range syms {
+		res = cs.addResults(res, cs.gi.callsTo(sym)...)
+	}
+
+	return res, nil
+}
+
+// findRegexp is queries 4 and 6, the lines matching re in any file.
+func (cs *cscope) findRegexp(re *regexp.Regexp) []cscopeResult {
+	res := []cscopeResult{}
+	for _, path := range cs.gi.files() {
+		for i, line := range cs.sourceLines(path) {
+			if !re.MatchString(line) {
+				continue
+			}
+
+			fn := "<global>"
+			loc := symbolLoc{getStringEncode(path), int16(i + 1), 1}
+			if sym := cs.gi.enclosingFunc(loc); sym != nil {
+				fn = sym.Name
+			}
+			res = append(res, cscopeResult{path, fn, i + 1})
+		}
+	}
+
+	return res
+}
+
+// findFile is query 7, the files with path matching the pattern.
+func (cs *cscope) findFile(pattern string) ([]cscopeResult, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []cscopeResult{}
+	for _, path := range cs.gi.files() {
+		if re.MatchString(path) {
+			res = append(res, cscopeResult{path, "<unknown>", 1})
+		}
+	}
+
+	return res, nil
+}
+
+// findIncluders is query 8, the files including the header. Only headers have
+// includers. The line is the first #include of the header name in the
+// includer.
+func (cs *cscope) findIncluders(pattern string) []cscopeResult {
+	res := []cscopeResult{}
+	for _, path := range cs.gi.files() {
+		if !matchPath(pattern, path) {
+			continue
+		}
+
+		htudb, err := cs.gi.db.GetSymbolsTUDB(getStringEncode(path))
+		if err != nil {
+			continue
+		}
+
+		for _, includer := range cs.gi.db.getListOfFilenames(htudb.Includers) {
+			line := 1
+			for i, text := range cs.sourceLines(includer) {
+				if strings.Contains(text, "#") &&
+					strings.Contains(text, "include") &&
+					strings.Contains(text, filepath.Base(path)) {
+					line = i + 1
+					break
+				}
+			}
+			res = append(res, cscopeResult{includer, "<global>", line})
+		}
+	}
+
+	return res
+}
+
+// findAssignments is query 9, the assignments to the symbol, including
+// compound assignments, increments and decrements.
+func (cs *cscope) findAssignments(pattern string) ([]cscopeResult, error) {
+	syms, err := cs.gi.lookupName(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []cscopeResult{}
+	for _, sym := range syms {
+		for _, use := range sym.Uses {
+			if use.Access == accessWrite || use.Access == accessReadWrite {
+				res = cs.addResults(res, use.Loc)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+func (cs *cscope) query(num byte, pattern string) ([]cscopeResult, error) {
+	switch num {
+	case '0':
+		return cs.findSymbol(pattern)
+	case '1':
+		return cs.findDefinition(pattern)
+	case '2':
+		return cs.findCallees(pattern)
+	case '3':
+		return cs.findCallers(pattern)
+	case '4':
+		return cs.findRegexp(regexp.MustCompile(regexp.QuoteMeta(pattern))), nil
+	case '6':
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		return cs.findRegexp(re), nil
+	case '7':
+		return cs.findFile(pattern)
+	case '8':
+		return cs.findIncluders(pattern), nil
+	case '9':
+		return cs.findAssignments(pattern)
+	}
+
+	return nil, fmt.Errorf("unsupported query %c", num)
+}
+
+// lineMode runs the line-oriented interface until EOF or the q command.
+func (cs *cscope) lineMode(in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	w := bufio.NewWriter(out)
+
+	for {
+		fmt.Fprint(w, ">> ")
+		w.Flush()
+
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+
+		switch line[0] {
+		case 'q':
+			return nil
+		case 'r', 'c', 'C':
+			// rebuild and case folding are not supported
+			continue
+		}
+
+		res, err := cs.query(line[0], strings.TrimSpace(line[1:]))
+		if err != nil {
+			fmt.Fprintf(w, "cscope: %v\n", err)
+			fmt.Fprintf(w, "cscope: 0 lines\n")
+			continue
+		}
+
+		sort.SliceStable(res, func(i, j int) bool {
+			if res[i].path != res[j].path {
+				return res[i].path < res[j].path
+			}
+			return res[i].line < res[j].line
+		})
+		fmt.Fprintf(w, "cscope: %d lines\n", len(res))
+		for _, r := range res {
+			fmt.Fprintf(w, "%s %s %d %s\n", r.path, r.fn, r.line,
+				cs.sourceLine(r.path, r.line))
+		}
+	}
+}
+
+///// cscope.out export
+
+type cscopeMark struct {
+	col  int
+	mark byte
+	name string
+}
+
+// cscope marks of the definitions, by declaration kind
+var cscopeDefMarks = map[string]byte{
+	"function":   '$',
+	"macro":      '#',
+	"struct":     's',
+	"union":      'u',
+	"enum":       'e',
+	"typedef":    't',
+	"member":     'm',
+	"enumerator": 'm',
+	"variable":   'g',
+	"local":      'l',
+	"parameter":  'p',
+}
+
+// fileMarks returns the symbols of every line of every file.
+func (cs *cscope) fileMarks() map[fileID]map[int][]cscopeMark {
+	marks := make(map[fileID]map[int][]cscopeMark)
+	add := func(loc symbolLoc, mark byte, name string) {
+		lines := marks[loc.File]
+		if lines == nil {
+			lines = make(map[int][]cscopeMark)
+			marks[loc.File] = lines
+		}
+		lines[int(loc.Line)] = append(lines[int(loc.Line)],
+			cscopeMark{int(loc.Col), mark, name})
+	}
+
+	for _, sym := range cs.gi.symbols {
+		for _, decl := range sym.Decls {
+			mark := byte(0)
+			if decl == sym.Def || !sym.DefAvail {
+				mark = cscopeDefMarks[sym.Kind]
+			}
+			add(decl, mark, sym.Name)
+		}
+		for _, use := range sym.Uses {
+			mark := byte(0)
+			switch {
+			case use.FuncCall:
+				mark = '`'
+			case use.Access == accessWrite || use.Access == accessReadWrite:
+				mark = '='
+			}
+			add(use.Loc, mark, sym.Name)
+		}
+	}
+
+	// end of function definitions, after the rest of the line
+	for fid, funcs := range cs.gi.funcs {
+		for _, fn := range funcs {
+			add(symbolLoc{fid, fn.End, math.MaxInt16}, '}', "")
+		}
+	}
+
+	return marks
+}
+
+// writeCrossRef writes the lines of a file with their symbols marked.
+func (cs *cscope) writeCrossRef(w io.Writer, path string, lines map[int][]cscopeMark) {
+	fmt.Fprintf(w, "\t@%s\n\n", path)
+
+	nums := []int{}
+	for num := range lines {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	src := cs.sourceLines(path)
+	for _, num := range nums {
+		if num < 1 || num > len(src) {
+			continue
+		}
+		text := src[num-1]
+		marks := lines[num]
+		sort.Slice(marks, func(i, j int) bool {
+			return marks[i].col < marks[j].col
+		})
+
+		fmt.Fprintf(w, "%d ", num)
+		pos := 0
+		for _, m := range marks {
+			start := m.col - 1
+			end := start + len(m.name)
+			if start < pos || end > len(text) {
+				start, end = len(text), len(text)
+			}
+			fmt.Fprintf(w, "%s\n", text[pos:start])
+			if m.mark != 0 {
+				fmt.Fprintf(w, "\t%c", m.mark)
+			}
+			fmt.Fprintf(w, "%s\n", m.name)
+			pos = end
+		}
+		fmt.Fprintf(w, "%s\n\n", text[pos:])
+	}
+}
+
+// export writes the cscope.out database of the files in the DB.
+func (cs *cscope) export(path string) error {
+	files := cs.gi.files()
+	marks := cs.fileMarks()
+
+	var body bytes.Buffer
+	for _, file := range files {
+		cs.writeCrossRef(&body, file, marks[getStringEncode(file)])
+		delete(cs.sources, file)
+	}
+	body.WriteString("\t@\n")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	header := fmt.Sprintf("cscope %d %s -c %010d\n", cscopeVersion, wd, 0)
+	trailer := len(header) + body.Len()
+	header = fmt.Sprintf("cscope %d %s -c %010d\n", cscopeVersion, wd, trailer)
+
+	// source dirs, include dirs and source files
+	fmt.Fprintf(&body, "1\n.\n0\n%d\n", len(files))
+	size := 0
+	for _, file := range files {
+		size += len(file) + 1
+	}
+	fmt.Fprintf(&body, "%d\n", size)
+	for _, file := range files {
+		fmt.Fprintf(&body, "%s\n", file)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.WriteString(f, header)
+	if err == nil {
+		_, err = body.WriteTo(f)
+	}
+
+	return err
+}
+
+// cscopeCmd is the cscope command.
+func cscopeCmd(args []string) error {
+	fs := flag.NewFlagSet("cscope", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	export := fs.String("export", "",
+		"Write a cscope.out database to this path instead of answering queries")
+	fs.Parse(args)
+
+	gi, err := openGlobalIndex(*dbDir)
+	if err != nil {
+		return err
+	}
+	cs := newCscope(gi)
+
+	if *export != "" {
+		return cs.export(*export)
+	}
+
+	return cs.lineMode(os.Stdin, os.Stdout)
+}
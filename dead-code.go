@@ -0,0 +1,261 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Dead code report: the symbols defined in the project without any use in the
+ * indexed files, merged across TUs with the global index. The symbols reported
+ * are the functions and global variables with a definition, and the macros,
+ * struct and union fields, enum constants and types declared in the project.
+ * Locals and parameters are not reported.
+ *
+ * Some symbols are used from outside the project (entry points, exported APIs),
+ * so they are allowed with:
+ *
+ * - DeadCodeAllow: symbol names, or regular expressions matching the whole
+ *   name. By default main and the header guards (names ending in _H or _H_).
+ * - DeadCodeAllowFiles: directories or file patterns (see matchPath) whose
+ *   symbols are never reported, e.g. the public headers.
+ *
+ * Uses that are not in the index (e.g. macros in #if conditions) may cause
+ * false positives, which can be allowed as well. The dead-code command reports
+ * the whole project, and the GetDeadCode request the symbols defined in a file,
+ * to be shown as diagnostics:
+ *
+ *   $ navc dead-code -allow 'plugin_.*' -allowFile include/ -format json
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+// DeadSymbol is a symbol without uses, located at its definition or first
+// declaration.
+type DeadSymbol struct {
+	File   string
+	Line   int
+	Col    int
+	Name   string
+	Kind   string
+	Static bool
+}
+
+// deadCodeKinds are the kinds of declarations reported.
+var deadCodeKinds = map[string]bool{
+	"function":   true,
+	"variable":   true,
+	"macro":      true,
+	"member":     true,
+	"enumerator": true,
+	"struct":     true,
+	"union":      true,
+	"enum":       true,
+	"typedef":    true,
+}
+
+type deadCodeAllow struct {
+	names []*regexp.Regexp
+	files []string
+}
+
+func newDeadCodeAllow(names, files []string) (*deadCodeAllow, error) {
+	allow := &deadCodeAllow{files: files}
+	for _, name := range names {
+		re, err := regexp.Compile("^(" + name + ")$")
+		if err != nil {
+			return nil, err
+		}
+		allow.names = append(allow.names, re)
+	}
+
+	return allow, nil
+}
+
+func (allow *deadCodeAllow) allowed(name, file string) bool {
+	for _, re := range allow.names {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	for _, pattern := range allow.files {
+		if matchFileFilter(pattern, file) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deadCode returns the symbols without uses, sorted by location. If file is not
+// empty, only the ones located in it are returned.
+func deadCode(gi *globalIndex, allow *deadCodeAllow, file string) []DeadSymbol {
+	dead := []DeadSymbol{}
+	for _, sym := range gi.symbols {
+		if !deadCodeKinds[sym.Kind] || len(sym.Uses) > 0 {
+			continue
+		}
+
+		var loc symbolLoc
+		switch {
+		case sym.DefAvail:
+			loc = sym.Def
+		case len(sym.Defs) > 0:
+			// global variables
+			loc = sym.Defs[0]
+		case sym.Kind == "function" || sym.Kind == "variable":
+			// declared only, defined outside of the project
+			continue
+		case len(sym.Decls) > 0:
+			loc = sym.Decls[0]
+		default:
+			continue
+		}
+
+		path := gi.path(loc.File)
+		if path == "" || file != "" && path != file ||
+			allow.allowed(sym.Name, path) {
+			continue
+		}
+		dead = append(dead, DeadSymbol{
+			File:   path,
+			Line:   int(loc.Line),
+			Col:    int(loc.Col),
+			Name:   sym.Name,
+			Kind:   sym.Kind,
+			Static: sym.Static,
+		})
+	}
+
+	sort.Slice(dead, func(i, j int) bool {
+		if dead[i].File != dead[j].File {
+			return dead[i].File < dead[j].File
+		}
+		if dead[i].Line != dead[j].Line {
+			return dead[i].Line < dead[j].Line
+		}
+		return dead[i].Col < dead[j].Col
+	})
+
+	return dead
+}
+
+// cachedGlobalIndex returns the global index of the DB. It is built again only
+// after a TUDB is inserted or removed, or if it was dropped to stay under the
+// memory budget. It is not kept if it does not fit.
+func (db *symbolsDB) cachedGlobalIndex() (*globalIndex, error) {
+	if db.global != nil {
+		return db.global, nil
+	}
+
+	gi, err := newGlobalIndex(db)
+	if err != nil {
+		return nil, err
+	}
+
+	size := gi.estimateSize()
+	if db.memBudget <= 0 || db.memUsed+size <= db.memBudget {
+		db.global = gi
+		db.globalSize = size
+		db.memUsed += size
+	}
+
+	return gi, nil
+}
+
+// GetDeadCode returns the symbols without uses located in file. The first
+// request after a change reads all the TUDBs, so it is slow on big projects.
+func (db *symbolsDB) GetDeadCode(file string) ([]DeadSymbol, error) {
+	allow, err := newDeadCodeAllow(cfg.DeadCodeAllow, cfg.DeadCodeAllowFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	gi, err := db.cachedGlobalIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return deadCode(gi, allow, filepath.Clean(file)), nil
+}
+
+///// dead-code command
+
+func writeDeadCode(w io.Writer, dead []DeadSymbol, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(dead)
+	case "text":
+		for _, sym := range dead {
+			linkage := ""
+			if sym.Static {
+				linkage = "static "
+			}
+			fmt.Fprintf(w, "%s:%d:%d: unused %s%s %s\n", sym.File,
+				sym.Line, sym.Col, linkage, sym.Kind, sym.Name)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// deadCodeCmd runs the dead-code command. The allowlists of the configuration
+// file are extended with the ones in the command line.
+func deadCodeCmd(args []string) error {
+	fs := flag.NewFlagSet("dead-code", flag.ExitOnError)
+	cfgFile := fs.String("config", defaultConfigFile,
+		"Path to the project configuration file")
+	dbDir := fs.String("db", "", "Path to symbols DB dir (default from config)")
+	format := fs.String("format", "text", "Output format: text or json")
+	names := []string{}
+	files := []string{}
+	fs.Var((*stringList)(&names), "allow",
+		"Symbol name or regular expression to allow, can be repeated")
+	fs.Var((*stringList)(&files), "allowFile",
+		"Directory or file pattern whose symbols are allowed, can be repeated")
+	fs.Parse(args)
+
+	pcfg, err := readConfig(*cfgFile)
+	if err != nil {
+		return err
+	}
+	if *dbDir == "" {
+		*dbDir = pcfg.DB
+	}
+
+	allow, err := newDeadCodeAllow(append(pcfg.DeadCodeAllow, names...),
+		append(pcfg.DeadCodeAllowFiles, files...))
+	if err != nil {
+		return err
+	}
+
+	gi, err := openGlobalIndex(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	return writeDeadCode(os.Stdout, deadCode(gi, allow, ""), *format)
+}
@@ -36,10 +36,22 @@ function! FindCursorSymbolUses()
 python navc.find_cursor_uses()
 endfunction
 
+" This function will find the uses writing the symbol under the cursor:
+" assignments, compound assignments, increments and decrements.
+function! FindCursorSymbolWrites()
+python navc.find_cursor_uses("write,readwrite")
+endfunction
+
 function! FindCursorSymbolDef()
 python navc.find_symbol_def()
 endfunction
 
+" This function will go to the definition of the struct, union or enum type of
+" the symbol under the cursor, following typedefs.
+function! FindCursorTypeDef()
+python navc.find_symbol_def("RequestHandler.GetTypeDef")
+endfunction
+
 function! MoveCursorToPrev()
 python navc.move_cursor_to_prev()
 endfunction
@@ -47,4 +59,6 @@ endfunction
 nnoremap <C-z>e :call FindCursorSymbolDecls()<ENTER>
 nnoremap <C-z>b :call MoveCursorToPrev()<ENTER>
 nnoremap <C-z>u :call FindCursorSymbolUses()<ENTER>
+nnoremap <C-z>w :call FindCursorSymbolWrites()<ENTER>
 nnoremap <C-z>d :call FindCursorSymbolDef()<ENTER>
+nnoremap <C-z>t :call FindCursorTypeDef()<ENTER>
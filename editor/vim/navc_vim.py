@@ -21,6 +21,9 @@ fname_char = re.compile('[a-zA-Z_]')
 
 prev_locs = []
 
+# last translation unit visited, used as context for queries in headers
+context_tu = None
+
 
 def __find_start_cur_symbol():
     row, col = vim.current.window.cursor
@@ -46,14 +49,20 @@ def __get_choice_int():
 
 
 def __get_cursor_input():
+    global context_tu
     line, col = __find_start_cur_symbol()
     fname = os.path.relpath(vim.current.buffer.name)
 
+    if fname.endswith('.c'):
+        context_tu = fname
+
     args = {
         "File": fname,
         "Line": line,
         "Col": col,
     }
+    if context_tu:
+        args["Context"] = context_tu
 
     return args
 
@@ -90,8 +99,10 @@ def __get_multi_choice(options):
         num = 1
         for op in options:
             line = __get_file_line(op['File'], op['Line'])
-            print "(%2d) %s %d\n     %s" % \
-                (num, op['File'], op['Line'], line)
+            ext = ' (external)' if op.get('External') else ''
+            access = ' [%s]' % op['Access'] if op.get('Access') else ''
+            print "(%2d) %s %d%s%s\n     %s" % \
+                (num, op['File'], op['Line'], access, ext, line)
             num += 1
         ch = __get_choice_int()
         ch -= 1
@@ -112,10 +123,12 @@ def find_cursor_decl():
         __print_error(e)
 
 
-def find_cursor_uses():
+def find_cursor_uses(access=None):
+    args = __get_cursor_input()
+    if access:
+        args["AccessFilter"] = access
     try:
-        ret = client.get_res(
-            "RequestHandler.GetSymbolUses", __get_cursor_input())
+        ret = client.get_res("RequestHandler.GetSymbolUses", args)
         ch = __get_multi_choice(ret)
         __save_and_move_cursor(ret[ch]['File'], ret[ch][
                                'Line'], ret[ch]['Col'] - 1)
@@ -125,10 +138,9 @@ def find_cursor_uses():
         pass
 
 
-def find_symbol_def():
+def find_symbol_def(request="RequestHandler.GetSymbolDef"):
     try:
-        ret = client.get_res("RequestHandler.GetSymbolDef",
-                             __get_cursor_input())
+        ret = client.get_res(request, __get_cursor_input())
         ch = __get_multi_choice(ret)
         __save_and_move_cursor(ret[ch]['File'], ret[ch][
                                'Line'], ret[ch]['Col'] - 1)
@@ -0,0 +1,202 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * External headers are the ones under the system and third-party include roots
+ * (SysInclDirs), e.g. libc, pthread or an SDK. By default, the symbols they
+ * declare are indexed as the ones of any other header, in the TUDB of every
+ * translation unit including them.
+ *
+ * With -indexExternal, the symbols located in external headers are not in the
+ * TUDBs of the project. They are kept in a cache shared by all the
+ * projects of the user (by default ~/.cache/navc/external), one file per
+ * header. The file has the DB format version, the path and hash of the header
+ * followed by a TUDB with only the symbols located in the header. A header is
+ * indexed only if it is not in the cache, its content changed or its file has
+ * another version, so the libc headers are indexed once, not once per project
+ * nor per translation unit.
+ *
+ * The first translation unit that indexes a header decides its content, e.g.
+ * the declarations enabled by its -D options. Queries look up the headers
+ * included by the translation unit in the cache, and mark the locations in
+ * external headers as External. The TUDBs read by queries are kept in memory
+ * by the symbols DB, under the same budget as the ones of the project.
+ */
+
+import (
+	"encoding/gob"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// externalStamp heads the cache file of a header. The cache is shared by all
+// the navc versions of the user, so Version is the DB format (dbVersion).
+type externalStamp struct {
+	Version string
+	File    string
+	Hash    fileHash
+}
+
+type externalIndex struct {
+	sync.Mutex
+
+	// include roots of the external headers
+	roots []string
+
+	// cache directory, empty if external headers are not indexed
+	dir string
+}
+
+// defaultExternalCache returns the user level directory of the external
+// headers cache.
+func defaultExternalCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+
+	return filepath.Join(dir, "navc", "external")
+}
+
+// newExternalIndex returns the index of the headers under roots. If cacheDir is
+// empty, they are not indexed.
+func newExternalIndex(roots []string, cacheDir string) (*externalIndex, error) {
+	if cacheDir != "" {
+		err := os.MkdirAll(cacheDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &externalIndex{
+		roots: roots,
+		dir:   cacheDir,
+	}, nil
+}
+
+// IsExternal checks if path is under one of the external include roots.
+func (ei *externalIndex) IsExternal(path string) bool {
+	if ei == nil {
+		return false
+	}
+
+	for _, root := range ei.roots {
+		if isUnderDir(path, root) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Enabled checks if external headers are indexed.
+func (ei *externalIndex) Enabled() bool {
+	return ei != nil && ei.dir != ""
+}
+
+func (ei *externalIndex) path(fid fileID) string {
+	return filepath.Join(ei.dir, hex.EncodeToString(fid[:]))
+}
+
+// load reads the cache file of a header. If stampOnly is true, the TUDB is not
+// decoded.
+func (ei *externalIndex) load(fid fileID, stampOnly bool) (*externalStamp, *symbolsTUDB, error) {
+	f, err := os.Open(ei.path(fid))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(f)
+
+	var stamp externalStamp
+	err = dec.Decode(&stamp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stampOnly || stamp.Version != dbVersion {
+		// the TUDB of other versions may not decode
+		return &stamp, nil, nil
+	}
+
+	var tudb symbolsTUDB
+	err = dec.Decode(&tudb)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &stamp, &tudb, nil
+}
+
+// Fresh checks if the header in path with content hash is already indexed.
+func (ei *externalIndex) Fresh(path string, hash fileHash) bool {
+	ei.Lock()
+	defer ei.Unlock()
+
+	stamp, _, err := ei.load(getStringEncode(path), true)
+	return err == nil && stamp.Version == dbVersion && stamp.File == path &&
+		stamp.Hash == hash
+}
+
+// Store saves the TUDB of an external header. The file is written aside and
+// renamed, as other navc processes may be reading it.
+func (ei *externalIndex) Store(tudb *symbolsTUDB) error {
+	ei.Lock()
+	defer ei.Unlock()
+
+	tmpFile, err := ioutil.TempFile(ei.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	enc := gob.NewEncoder(tmpFile)
+	err = enc.Encode(&externalStamp{dbVersion, tudb.File, tudb.Hash})
+	if err == nil {
+		err = enc.Encode(tudb)
+	}
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), ei.path(getStringEncode(tudb.File)))
+}
+
+// Get reads the TUDB of an external header, or returns nil if it is not
+// indexed. The TUDBs are cached by the symbols DB (getExternalTUDB).
+func (ei *externalIndex) Get(fid fileID) *symbolsTUDB {
+	if !ei.Enabled() {
+		return nil
+	}
+
+	ei.Lock()
+	defer ei.Unlock()
+
+	stamp, tudb, err := ei.load(fid, false)
+	if err != nil || stamp.Version != dbVersion {
+		return nil
+	}
+
+	return tudb
+}
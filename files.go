@@ -53,11 +53,39 @@ package main
  *   +----------------+
  */
 
+/*
+ * Headers get symbols only through their includers. A header that no
+ * translation unit includes (e.g. a new API header or a header-only library)
+ * is parsed as its own translation unit (standalone), with the compilation
+ * arguments inferred from its neighbors. As includers may not be parsed yet,
+ * the headers without includers are collected in orphanHeaders and parsed only
+ * when idle (parseOrphanHeaders). The standalone translation unit is dropped
+ * by the DB once a real includer is inserted.
+ */
+
+/*
+ * In build-driven mode (-buildDriven), the translation units are the files in
+ * the compilation databases (compile_commands.json) instead of every C file in
+ * the index directories. This includes files outside the index directories,
+ * e.g. generated sources in an out of tree build directory, whose directories
+ * are also watched. C files not in the compilation databases are handled like
+ * any other non translation unit file.
+ */
+
+/*
+ * File system events are not handled right away. Editors save via
+ * write-then-rename and build tools touch files in bursts, so the events of
+ * each path are coalesced until the path is quiet for quietPeriod
+ * (queueChange). Then, a single event describing the final state of the path
+ * is handled (flushChanges). For instance, a header removed and created again
+ * is seen as a single write.
+ */
+
 /*
  * NOTE: There is a potential race if a included header is removed and created
- * quickly (this could be the case for vim and its backup files). To exemplofy
- * the issue, assume a file a.c that includes a header b.h. The race goes like
- * this:
+ * again after the quiet period (this could be the case for vim and its backup
+ * files). To exemplofy the issue, assume a file a.c that includes a header b.h.
+ * The race goes like this:
  * 1. b.h is removed and navc quickly reparse a.c but does not add it yet to the
  *    DB. This new TUDB will have b.h as a potential header, but not a real one.
  * 2. While parsing, b.h is created again and navc look for potential files
@@ -77,7 +105,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
-	"regexp"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
@@ -85,14 +113,7 @@ import (
 	fsnotify "gopkg.in/fsnotify.v1"
 )
 
-const validCString string = `^[^\.].*\.c$`
-const validHString string = `^[^\.].*\.h$`
-const flushTime int = 10
-
-var sysInclDir = map[string]bool{
-	"/usr/include/": true,
-	"/usr/lib/":     true,
-}
+var cfg *config
 
 var toParseMap map[string]bool
 var toParseQueue *list.List
@@ -101,11 +122,35 @@ var nIndexingThreads int
 var parseFile chan string
 var doneFile chan *symbolsTUDB
 var foundFile, foundHeader, removeFile chan string
+var doneExploring chan bool
+var exploring bool
+var orphanHeaders map[string]bool
 var flush <-chan time.Time
+var flushTicker *time.Ticker
 var newConn chan net.Conn
 
+// events waiting for their path to be quiet
+type pendingEvent struct {
+	op   fsnotify.Op
+	last time.Time
+}
+
+var pendingEvents map[string]*pendingEvent
+var debounce <-chan time.Time
+var debounceTicker *time.Ticker
+
 var wg sync.WaitGroup
-var watcher *fsnotify.Watcher
+var watcher fileWatcher
+var ignores *ignoreMatcher
+
+// compilation databases
+var compDB *compileDB
+
+// system and third-party headers (see external.go)
+var extIndex *externalIndex
+
+// tags file kept updated, nil if none
+var tags *tagsFile
 
 var db *symbolsDB
 var rh *RequestHandler
@@ -122,13 +167,22 @@ func traversePath(path string, visitDir func(string), visitC func(string), visit
 			if info.Name() != "." && info.Name()[0] == '.' {
 				return filepath.SkipDir
 			}
+			if ignores.match(path, true) {
+				return filepath.SkipDir
+			}
+			// before walking the dir, its entries may be ignored
+			if err := ignores.LoadDir(path); err != nil {
+				log.Println("unable to read ignore rules of", path, err)
+			}
 
 			visitDir(path)
 			return nil
 		}
+		if ignores.match(path, false) {
+			return nil
+		}
 		// ignore non-C files
-		validC, _ := regexp.MatchString(validCString, path)
-		if validC {
+		if isTUFile(path) {
 			visitC(path)
 		} else {
 			visitRest(path)
@@ -138,6 +192,23 @@ func traversePath(path string, visitDir func(string), visitC func(string), visit
 	})
 }
 
+func isCFile(path string) bool {
+	return hasExtension(path, cfg.CExtensions)
+}
+
+func isHFile(path string) bool {
+	return hasExtension(path, cfg.HExtensions)
+}
+
+// isTUFile checks if path should be parsed as a translation unit.
+func isTUFile(path string) bool {
+	if cfg.BuildDriven {
+		return compDB.Has(path)
+	}
+
+	return isCFile(path)
+}
+
 func queueFileToParse(filePath string) {
 	if len(inFlight) < nIndexingThreads && !inFlight[filePath] {
 		inFlight[filePath] = true
@@ -157,6 +228,7 @@ func queueFilesToParse(files ...string) {
 func doneFileToParse(tudb *symbolsTUDB) {
 	if !toParseMap[tudb.File] {
 		db.InsertTUDB(tudb)
+		tags.Update(tudb)
 	}
 
 	delete(inFlight, tudb.File)
@@ -181,21 +253,83 @@ func parseIncluders(headerPath string) {
 	queueFilesToParse(toParse...)
 }
 
+// handleHeader handles a new or changed header file.
+func handleHeader(headerPath string) {
+	if db.IsStandalone(headerPath) {
+		exist, uptodate, err := db.UptodateFile(headerPath)
+		if err == nil && exist && !uptodate {
+			queueFilesToParse(headerPath)
+		}
+		return
+	}
+
+	parseIncluders(headerPath)
+	if isHFile(headerPath) && !db.FileExist(headerPath) {
+		orphanHeaders[headerPath] = true
+	}
+}
+
+// removeTU removes a translation unit from the DB and the tags file.
+func removeTU(file string) {
+	db.RemoveFileReferences(file)
+	tags.Remove(getStringEncode(file))
+}
+
+// removeHeader handles a removed header file.
+func removeHeader(headerPath string) {
+	if db.IsStandalone(headerPath) {
+		removeTU(headerPath)
+		return
+	}
+
+	parseIncluders(headerPath)
+}
+
+// parseOrphanHeaders parses standalone the headers that still have no
+// includers.
+func parseOrphanHeaders() {
+	for _, header := range db.TakeOrphanedHeaders() {
+		if isHFile(header) && inIndexedTree(header) {
+			orphanHeaders[header] = true
+		}
+	}
+
+	for header := range orphanHeaders {
+		delete(orphanHeaders, header)
+
+		if db.FileExist(header) || ignores.Ignored(header, false) {
+			continue
+		}
+		if _, err := os.Stat(header); err != nil {
+			continue
+		}
+		queueFilesToParse(header)
+	}
+}
+
 func handleFileChange(event fsnotify.Event) {
-	validC, _ := regexp.MatchString(validCString, event.Name)
-	validH, _ := regexp.MatchString(validHString, event.Name)
+	validC := isTUFile(event.Name)
+	validH := isHFile(event.Name)
 
 	switch {
 	case validC:
 		switch {
 		case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+			exist, uptodate, err := db.UptodateFile(event.Name)
+			if err == nil && exist && uptodate {
+				// same content, nothing to do
+				return
+			}
 			queueFilesToParse(event.Name)
 		case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
-			db.RemoveFileReferences(event.Name)
+			removeTU(event.Name)
 		}
 	case validH:
-		if event.Op&(fsnotify.Write|fsnotify.Remove|fsnotify.Rename|fsnotify.Create) != 0 {
-			parseIncluders(event.Name)
+		switch {
+		case event.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+			removeHeader(event.Name)
+		case event.Op&(fsnotify.Create|fsnotify.Write) != 0:
+			handleHeader(event.Name)
 		}
 	}
 }
@@ -230,7 +364,236 @@ func isDirectory(path string) (bool, error) {
 	return fi.IsDir(), nil
 }
 
+func isUnderDir(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && !strings.HasPrefix(rel, "..")
+}
+
+// reparseDir parses again all the translation units under dir, e.g. when their
+// compilation arguments changed.
+func reparseDir(dir string) {
+	for file := range db.GetSetFilesInDB() {
+		if !isTUFile(file) && !db.IsStandalone(file) {
+			continue
+		}
+		if isUnderDir(file, dir) {
+			queueFilesToParse(file)
+		}
+	}
+}
+
+// syncBuildFiles updates the translation units in the DB to the ones in the
+// compilation databases in build-driven mode.
+func syncBuildFiles() {
+	inDB := db.GetSetFilesInDB()
+
+	for _, file := range compDB.Files() {
+		if !inDB[file] && !ignores.Ignored(file, false) {
+			watcher.Add(filepath.Dir(file))
+			queueFilesToParse(file)
+		}
+	}
+
+	for file := range inDB {
+		if isCFile(file) && !compDB.Has(file) {
+			removeTU(file)
+		}
+	}
+}
+
+// tuArgs returns the compilation arguments of the translation units in the DB.
+func tuArgs() map[string][]string {
+	args := make(map[string][]string)
+	for file := range db.GetSetFilesInDB() {
+		if isTUFile(file) || db.IsStandalone(file) {
+			args[file], _ = compDB.Args(file)
+		}
+	}
+
+	return args
+}
+
+// handleCompileDBChange handles changes of the compilation databases and flag
+// files. It returns false if path is not one of them.
+func handleCompileDBChange(path string) bool {
+	switch {
+	case filepath.Base(path) == "compile_commands.json":
+		oldArgs := tuArgs()
+		err := compDB.Reload()
+		if err != nil {
+			log.Println("unable to reload", path, err)
+			return true
+		}
+		if cfg.BuildDriven {
+			syncBuildFiles()
+		}
+		// only the files whose arguments changed, build tools rewrite the
+		// compilation databases on every build
+		for file, args := range oldArgs {
+			if !isTUFile(file) && !db.IsStandalone(file) {
+				continue
+			}
+			newArgs, _ := compDB.Args(file)
+			if !reflect.DeepEqual(args, newArgs) {
+				queueFilesToParse(file)
+			}
+		}
+	case isFlagFile(path):
+		compDB.InvalidateFlagDir(filepath.Dir(path))
+		reparseDir(filepath.Dir(path))
+	default:
+		return false
+	}
+
+	return true
+}
+
+func setTickers() {
+	if flushTicker != nil {
+		flushTicker.Stop()
+	}
+	flushTicker = time.NewTicker(time.Duration(cfg.FlushInterval))
+	flush = flushTicker.C
+
+	if debounceTicker != nil {
+		debounceTicker.Stop()
+		debounceTicker = nil
+		debounce = nil
+	}
+	if cfg.QuietPeriod > 0 {
+		debounceTicker = time.NewTicker(time.Duration(cfg.QuietPeriod) / 2)
+		debounce = debounceTicker.C
+	}
+}
+
+// setIgnores replaces the ignore rules. The files ignored before are indexed,
+// and the ones ignored now are removed from the DB. The ignore files of the
+// subdirectories are read by the walk, so the removed files are only known
+// after it.
+func setIgnores(newIgnores *ignoreMatcher) {
+	oldIgnores := ignores.replace(newIgnores)
+
+	// the walk skips the directories ignored now, so only the ones
+	// ignored before are new
+	visitorDir := func(path string) {
+		if oldIgnores.Ignored(path, true) {
+			watcher.Add(path)
+		}
+	}
+	visitorC := func(path string) {
+		if oldIgnores.Ignored(path, false) {
+			queueFilesToParse(path)
+		}
+	}
+	visitorRest := func(path string) {
+		if oldIgnores.Ignored(path, false) {
+			handleHeader(path)
+		}
+	}
+	for _, dir := range cfg.IndexDirs {
+		traversePath(dir, visitorDir, visitorC, visitorRest)
+	}
+
+	for file := range db.GetSetFilesInDB() {
+		if oldIgnores.Ignored(file, false) || !ignores.Ignored(file, false) {
+			continue
+		}
+		if isHFile(file) {
+			removeHeader(file)
+		} else {
+			removeTU(file)
+		}
+	}
+	if cfg.BuildDriven {
+		syncBuildFiles()
+	}
+}
+
+// applyConfig applies the settings of a reloaded configuration that are safe to
+// change on a running daemon.
+func applyConfig(newCfg *config) {
+	if newCfg.GitIgnore != cfg.GitIgnore ||
+		!reflect.DeepEqual(newCfg.Exclude, cfg.Exclude) ||
+		!reflect.DeepEqual(newCfg.Include, cfg.Include) {
+		newIgnores, err := newIgnoreMatcher(cfg.IndexDirs, newCfg.GitIgnore,
+			newCfg.Exclude, newCfg.Include)
+		if err != nil {
+			log.Println("unable to read ignore rules", err)
+		} else {
+			cfg.GitIgnore = newCfg.GitIgnore
+			cfg.Exclude = newCfg.Exclude
+			cfg.Include = newCfg.Include
+			setIgnores(newIgnores)
+		}
+	}
+
+	if newCfg.FlushInterval != cfg.FlushInterval ||
+		newCfg.QuietPeriod != cfg.QuietPeriod {
+		cfg.FlushInterval = newCfg.FlushInterval
+		cfg.QuietPeriod = newCfg.QuietPeriod
+		setTickers()
+	}
+
+	if newCfg.CacheMemory != cfg.CacheMemory {
+		cfg.CacheMemory = newCfg.CacheMemory
+		db.SetMemBudget(cfg.CacheMemory << 20)
+	}
+
+	// anything else needs a restart
+	if !reflect.DeepEqual(cfg, newCfg) {
+		log.Println("some settings in", configPath,
+			"are only applied after restarting navc")
+	}
+}
+
+// handleSettingsChange handles changes of the configuration and ignore files.
+// It returns false if path is not one of them.
+func handleSettingsChange(path string) bool {
+	base := filepath.Base(path)
+	switch {
+	case isConfigFile(path):
+		newCfg, err := reloadConfig()
+		if err != nil {
+			log.Println("unable to reload configuration", err)
+			return true
+		}
+		applyConfig(newCfg)
+	case base == ".navcignore" || (base == ".gitignore" && cfg.GitIgnore):
+		newIgnores, err := newIgnoreMatcher(cfg.IndexDirs, cfg.GitIgnore,
+			cfg.Exclude, cfg.Include)
+		if err != nil {
+			log.Println("unable to read ignore rules", err)
+			return true
+		}
+		setIgnores(newIgnores)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// inIndexedTree checks if path is under an index dir or, in build-driven mode,
+// in the directory of a translation unit.
+func inIndexedTree(path string) bool {
+	for _, dir := range cfg.IndexDirs {
+		if isUnderDir(path, dir) {
+			return true
+		}
+	}
+
+	return cfg.BuildDriven && compDB.HasDir(filepath.Dir(path))
+}
+
 func handleChange(event fsnotify.Event) {
+	if handleSettingsChange(event.Name) || handleCompileDBChange(event.Name) {
+		return
+	}
+
+	// e.g. other files next to the configuration file
+	if !inIndexedTree(event.Name) {
+		return
+	}
 
 	// ignore if hidden
 	if filepath.Base(event.Name)[0] == '.' {
@@ -248,6 +611,10 @@ func handleChange(event fsnotify.Event) {
 		return
 	}
 
+	if ignores.Ignored(event.Name, isDir) {
+		return
+	}
+
 	if isDir {
 		handleDirChange(event)
 	} else {
@@ -255,8 +622,52 @@ func handleChange(event fsnotify.Event) {
 	}
 }
 
+func queueChange(event fsnotify.Event) {
+	if cfg.QuietPeriod == 0 {
+		handleChange(event)
+		return
+	}
+
+	pending := pendingEvents[event.Name]
+	if pending == nil {
+		pending = &pendingEvent{}
+		pendingEvents[event.Name] = pending
+	}
+	pending.op |= event.Op
+	pending.last = time.Now()
+}
+
+// coalesceEvent returns a single event equivalent to the burst of operations
+// op on path. The current state of the path decides the final operation.
+func coalesceEvent(path string, op fsnotify.Op) fsnotify.Event {
+	_, err := os.Lstat(path)
+	switch {
+	case err != nil:
+		// whatever happened, the path is gone
+		op = fsnotify.Remove
+	case op&fsnotify.Create != 0:
+		op = fsnotify.Create
+	case op&(fsnotify.Remove|fsnotify.Rename) != 0:
+		// replaced by some other file, e.g. write-then-rename
+		op = fsnotify.Write
+	}
+
+	return fsnotify.Event{Name: path, Op: op}
+}
+
+func flushChanges(now time.Time) {
+	for path, pending := range pendingEvents {
+		if now.Sub(pending.last) < time.Duration(cfg.QuietPeriod) {
+			continue
+		}
+
+		delete(pendingEvents, path)
+		handleChange(coalesceEvent(path, pending.op))
+	}
+}
+
 func isSysInclDir(path string) bool {
-	for incl := range sysInclDir {
+	for _, incl := range cfg.SysInclDirs {
 		if strings.HasPrefix(path, incl) {
 			return true
 		}
@@ -265,25 +676,24 @@ func isSysInclDir(path string) bool {
 	return false
 }
 
-func parseFiles(indexDir []string) {
+func parseFiles() {
 	wg.Add(1)
 	defer wg.Done()
 
-	pa := newParser(indexDir)
+	pa := newParser(compDB, extIndex)
 
 	for file := range parseFile {
-		log.Println("parsing", file)
 		doneFile <- pa.Parse(file)
 	}
 }
 
-func handleFiles(indexDir []string) {
+func handleFiles() {
 	wg.Add(1)
 	defer wg.Done()
 
 	// start threads to process files
 	for i := 0; i < nIndexingThreads; i++ {
-		go parseFiles(indexDir)
+		go parseFiles()
 	}
 
 	for {
@@ -295,28 +705,37 @@ func handleFiles(indexDir []string) {
 			}
 			doneFileToParse(tudb)
 			// process changes in files
-		case event := <-watcher.Events:
-			handleChange(event)
-		case err := <-watcher.Errors:
+		case event := <-watcher.Events():
+			queueChange(event)
+		case now := <-debounce:
+			flushChanges(now)
+		case err := <-watcher.Errors():
 			log.Println("watcher error: ", err)
 		// process explored files
 		case header := <-foundHeader:
-			parseIncluders(header)
+			handleHeader(header)
 		case file := <-foundFile:
 			exist, uptodate, err := db.UptodateFile(file)
 			if err == nil && (!exist || !uptodate) {
 				queueFilesToParse(file)
 			}
+		case <-doneExploring:
+			exploring = false
 		case file := <-removeFile:
-			validH, _ := regexp.MatchString(validHString, file)
-			if validH {
-				parseIncluders(file)
+			if isHFile(file) {
+				removeHeader(file)
 			} else {
-				db.RemoveFileReferences(file)
+				removeTU(file)
 			}
 		// flush frequently to disk
 		case <-flush:
-			db.FlushDB(time.Now().Add(-time.Duration(flushTime) * time.Second))
+			db.FlushDB(time.Now().Add(-time.Duration(cfg.FlushInterval)))
+			if err := tags.Write(db, false); err != nil {
+				log.Println("unable to write tags file:", err)
+			}
+			if !exploring && len(inFlight) == 0 && toParseQueue.Len() == 0 {
+				parseOrphanHeaders()
+			}
 		// handle requests
 		case conn := <-newConn:
 			rh.handleRequest(conn)
@@ -330,6 +749,7 @@ func exploreIndexDir(indexDir []string) {
 
 	// explore all the paths in indexDir and process all files
 	notExplored := db.GetSetFilesInDB()
+	exploredC := map[string]bool{}
 	visitorDir := func(path string) {
 		// add watcher to directory
 		watcher.Add(path)
@@ -337,6 +757,7 @@ func exploreIndexDir(indexDir []string) {
 	visitorC := func(path string) {
 		// update set of removed files
 		delete(notExplored, path)
+		exploredC[path] = true
 		// put file in channel
 		foundFile <- path
 	}
@@ -351,6 +772,20 @@ func exploreIndexDir(indexDir []string) {
 		traversePath(path, visitorDir, visitorC, visitorRest)
 	}
 
+	// in build-driven mode, the translation units outside the index dirs
+	if cfg.BuildDriven {
+		for _, path := range compDB.Files() {
+			if exploredC[path] || ignores.Ignored(path, false) {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				continue
+			}
+			visitorDir(filepath.Dir(path))
+			visitorC(path)
+		}
+	}
+
 	// check files not explored by now
 	for path := range notExplored {
 		if isSysInclDir(path) {
@@ -361,32 +796,69 @@ func exploreIndexDir(indexDir []string) {
 			removeFile <- path
 		}
 	}
+
+	doneExploring <- true
 }
 
-func startFilesHandler(indexDir []string, inputIndexThreads int, dbDir string) error {
+func startFilesHandler(inputCfg *config) error {
 	var err error
 
+	cfg = inputCfg
 	toParseMap = make(map[string]bool)
 	toParseQueue = list.New()
 	inFlight = make(map[string]bool)
-	nIndexingThreads = inputIndexThreads
+	nIndexingThreads = cfg.Threads
+	ignores, err = newIgnoreMatcher(cfg.IndexDirs, cfg.GitIgnore,
+		cfg.Exclude, cfg.Include)
+	if err != nil {
+		return err
+	}
+	compDB = newCompileDB(cfg.IndexDirs)
+	extCache := ""
+	if cfg.IndexExternal {
+		extCache = cfg.ExternalCache
+	}
+	extIndex, err = newExternalIndex(cfg.SysInclDirs, extCache)
+	if err != nil {
+		return err
+	}
 	parseFile = make(chan string)
 	doneFile = make(chan *symbolsTUDB)
 	foundFile = make(chan string)
 	foundHeader = make(chan string)
 	removeFile = make(chan string)
+	doneExploring = make(chan bool)
+	exploring = true
+	orphanHeaders = make(map[string]bool)
 	newConn = make(chan net.Conn)
-	watcher, err = fsnotify.NewWatcher()
+	watcher, err = newFileWatcher(cfg.Watcher,
+		time.Duration(cfg.PollInterval))
 	if err != nil {
 		return err
 	}
-	flush = time.Tick(time.Duration(flushTime) * time.Second)
-	db = newSymbolsDB(dbDir)
+	pendingEvents = make(map[string]*pendingEvent)
+	setTickers()
+	db = newSymbolsDB(cfg.DB, cfg.CacheMemory<<20)
+	db.SetExternalIndex(extIndex)
+	for _, spec := range cfg.Bundles {
+		b, err := loadBundle(spec)
+		if err != nil {
+			return err
+		}
+		db.AddBundle(b)
+	}
 	rh = newRequestHandler(db)
+	if cfg.TagsFile != "" {
+		tags = newTagsFile(cfg.TagsFile, cfg.TagsFormat, db)
+	}
+
+	// the configuration file is at the project root, which may not be
+	// an index dir
+	watcher.Add(filepath.Dir(configPath))
 
-	go listenRequests(newConn)
-	go handleFiles(indexDir)
-	go exploreIndexDir(indexDir)
+	go listenRequests(newConn, cfg.Socket)
+	go handleFiles()
+	go exploreIndexDir(cfg.IndexDirs)
 
 	return nil
 }
@@ -399,4 +871,9 @@ func closeFilesHandler() {
 	wg.Wait()
 
 	db.FlushDB(time.Now())
+	tags.Write(db, true)
+
+	stats := db.GetCacheStats()
+	log.Println("cache stats: hits", stats.Hits, "misses", stats.Misses,
+		"evictions", stats.Evictions)
 }
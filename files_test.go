@@ -0,0 +1,369 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Tests of the files handler driven through the watcher abstraction. The
+ * handler state is set up as in startFilesHandler, but no parser is started:
+ * the files sent to parse are read from parseFile instead. The events of the
+ * watcher are handled as in handleFiles (pumpEvents).
+ */
+
+import (
+	"container/list"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+const testPollInterval = 10 * time.Millisecond
+const testTimeout = 5 * time.Second
+
+// fakeWatcher is a notify backend whose events are sent by the test, and whose
+// Add fails for the paths in fail.
+type fakeWatcher struct {
+	mu     sync.Mutex
+	dirs   map[string]bool
+	fail   map[string]error
+	events chan fsnotify.Event
+	errors chan error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{
+		dirs:   make(map[string]bool),
+		fail:   make(map[string]error),
+		events: make(chan fsnotify.Event, 16),
+		errors: make(chan error),
+	}
+}
+
+func (fw *fakeWatcher) Add(path string) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if err := fw.fail[path]; err != nil {
+		return err
+	}
+	fw.dirs[path] = true
+
+	return nil
+}
+
+func (fw *fakeWatcher) Remove(path string) error {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	delete(fw.dirs, path)
+
+	return nil
+}
+
+func (fw *fakeWatcher) watched(path string) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	return fw.dirs[path]
+}
+
+func (fw *fakeWatcher) Events() <-chan fsnotify.Event {
+	return fw.events
+}
+
+func (fw *fakeWatcher) Errors() <-chan error {
+	return fw.errors
+}
+
+func (fw *fakeWatcher) Close() error {
+	return nil
+}
+
+// setupFilesHandler initializes the files handler state for an empty index
+// directory watched by w, and returns the directory.
+func setupFilesHandler(t *testing.T, w fileWatcher) string {
+	dir, err := ioutil.TempDir("", "navc-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg = defaultConfig()
+	cfg.IndexDirs = []string{dir}
+	cfg.DB = filepath.Join(dir, ".navc_dbsymbols")
+	cfg.QuietPeriod = 0
+	configPath = ""
+
+	toParseMap = make(map[string]bool)
+	toParseQueue = list.New()
+	inFlight = make(map[string]bool)
+	nIndexingThreads = 1
+	ignores, err = newIgnoreMatcher(cfg.IndexDirs, false, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compDB = newCompileDB(cfg.IndexDirs)
+	parseFile = make(chan string, 64)
+	orphanHeaders = make(map[string]bool)
+	newConn = make(chan net.Conn)
+	pendingEvents = make(map[string]*pendingEvent)
+	db = newSymbolsDB(cfg.DB, 0)
+	watcher = w
+
+	err = watcher.Add(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func teardownFilesHandler(dir string) {
+	watcher.Close()
+	os.RemoveAll(dir)
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// pumpEvents handles the watcher events, as handleFiles, until file is sent
+// to parse.
+func pumpEvents(t *testing.T, file string) {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case event := <-watcher.Events():
+			queueChange(event)
+		case err := <-watcher.Errors():
+			t.Fatal("watcher error:", err)
+		case parsed := <-parseFile:
+			delete(inFlight, parsed)
+			if parsed == file {
+				return
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for", file, "to be parsed")
+		}
+	}
+}
+
+// testNewFiles checks that new files and new directories with files are
+// parsed.
+func testNewFiles(t *testing.T, dir string) {
+	file := filepath.Join(dir, "a.c")
+	writeTestFile(t, file, "int a;\n")
+	pumpEvents(t, file)
+
+	sub := filepath.Join(dir, "sub")
+	err := os.Mkdir(sub, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file = filepath.Join(sub, "b.c")
+	writeTestFile(t, file, "int b;\n")
+	pumpEvents(t, file)
+}
+
+func TestFilesHandlerFsnotify(t *testing.T) {
+	w, err := newFileWatcher("fsnotify", testPollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := setupFilesHandler(t, w)
+	defer teardownFilesHandler(dir)
+
+	testNewFiles(t, dir)
+}
+
+func TestFilesHandlerPoll(t *testing.T) {
+	w, err := newFileWatcher("poll", testPollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := setupFilesHandler(t, w)
+	defer teardownFilesHandler(dir)
+
+	testNewFiles(t, dir)
+
+	// writes are found by the stamps of the known files
+	file := filepath.Join(dir, "a.c")
+	writeTestFile(t, file, "int a = 1;\n")
+	pumpEvents(t, file)
+}
+
+func TestFilesHandlerHybrid(t *testing.T) {
+	w, err := newFileWatcher("hybrid", testPollInterval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := setupFilesHandler(t, w)
+	defer teardownFilesHandler(dir)
+
+	testNewFiles(t, dir)
+
+	// the directories with changes are watched with fsnotify
+	cw := w.(*comboWatcher)
+	cw.mu.Lock()
+	hot := cw.hotElem[dir] != nil
+	cw.mu.Unlock()
+	if !hot {
+		t.Error(dir, "not watched with fsnotify after a change")
+	}
+}
+
+func TestFilesHandlerHybridDuplicates(t *testing.T) {
+	notify := newFakeWatcher()
+	cw := newComboWatcher(notify, true, testPollInterval)
+	dir := setupFilesHandler(t, cw)
+	defer teardownFilesHandler(dir)
+
+	file := filepath.Join(dir, "a.c")
+	writeTestFile(t, file, "int a;\n")
+	pumpEvents(t, file)
+	if !notify.watched(dir) {
+		t.Fatal(dir, "not watched with fsnotify after a change")
+	}
+
+	// the changes in hot directories are reported by fsnotify only
+	writeTestFile(t, file, "int a = 1;\n")
+	select {
+	case event := <-cw.Events():
+		t.Fatal("change reported by polling:", event)
+	case <-time.After(10 * testPollInterval):
+	}
+
+	notify.events <- fsnotify.Event{Name: file, Op: fsnotify.Write}
+	pumpEvents(t, file)
+}
+
+func TestFilesHandlerAutoFallback(t *testing.T) {
+	notify := newFakeWatcher()
+	cw := newComboWatcher(notify, false, testPollInterval)
+	dir := setupFilesHandler(t, cw)
+	defer teardownFilesHandler(dir)
+
+	if !notify.watched(dir) {
+		t.Fatal(dir, "not watched with fsnotify")
+	}
+
+	limits := map[string]error{
+		"emfile": syscall.EMFILE,
+		"enospc": syscall.ENOSPC,
+	}
+	for name, limitErr := range limits {
+		sub := filepath.Join(dir, name)
+		err := os.Mkdir(sub, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		notify.fail[sub] = limitErr
+
+		err = cw.Add(sub)
+		if err != nil {
+			t.Fatal("no fallback to polling on", limitErr, err)
+		}
+		if notify.watched(sub) {
+			t.Fatal(sub, "watched with fsnotify after", limitErr)
+		}
+
+		// the changes in the directory are found by polling
+		file := filepath.Join(sub, "a.c")
+		writeTestFile(t, file, "int a;\n")
+		pumpEvents(t, file)
+	}
+
+	// other errors are reported
+	sub := filepath.Join(dir, "eacces")
+	notify.fail[sub] = syscall.EACCES
+	if cw.Add(sub) == nil {
+		t.Error("error of fsnotify not reported")
+	}
+}
+
+func TestFilesHandlerQuietPeriod(t *testing.T) {
+	notify := newFakeWatcher()
+	dir := setupFilesHandler(t, notify)
+	defer teardownFilesHandler(dir)
+	cfg.QuietPeriod = configDuration(time.Second)
+
+	// write-then-rename of an editor
+	file := filepath.Join(dir, "a.c")
+	writeTestFile(t, file, "int a;\n")
+	for _, op := range []fsnotify.Op{fsnotify.Create, fsnotify.Rename, fsnotify.Create} {
+		queueChange(fsnotify.Event{Name: file, Op: op})
+	}
+
+	flushChanges(time.Now())
+	if len(parseFile) != 0 {
+		t.Fatal(file, "parsed before the quiet period")
+	}
+
+	flushChanges(time.Now().Add(time.Duration(cfg.QuietPeriod)))
+	if len(parseFile) != 1 || <-parseFile != file {
+		t.Fatal(file, "not parsed once after the quiet period")
+	}
+}
+
+func TestFilesHandlerNestedIgnore(t *testing.T) {
+	dir := setupFilesHandler(t, newFakeWatcher())
+	defer teardownFilesHandler(dir)
+
+	var err error
+	ignores, err = newIgnoreMatcher(cfg.IndexDirs, true, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sub := filepath.Join(dir, "sub")
+	err = os.Mkdir(sub, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, ".gitignore"), "*.gen.c\n")
+	writeTestFile(t, filepath.Join(sub, ".gitignore"), "!keep.gen.c\n/local.c\n")
+	for _, name := range []string{"a.gen.c", "local.c", "sub/b.gen.c",
+		"sub/keep.gen.c", "sub/local.c", "sub/c.c"} {
+		writeTestFile(t, filepath.Join(dir, name), "int x;\n")
+	}
+
+	found := []string{}
+	traversePath(dir, func(string) {}, func(path string) {
+		rel, _ := filepath.Rel(dir, path)
+		found = append(found, filepath.ToSlash(rel))
+	}, func(string) {})
+
+	// the patterns of sub/.gitignore are relative to sub, and override
+	// the ones of its parent
+	want := []string{"local.c", "sub/c.c", "sub/keep.gen.c"}
+	if strings.Join(found, " ") != strings.Join(want, " ") {
+		t.Errorf("found %v, want %v", found, want)
+	}
+}
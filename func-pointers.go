@@ -0,0 +1,220 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Indirect calls through function pointers. A call like ops->open() is a use
+ * of the field open, so the call hierarchy stops there. The parser records
+ * every function stored into a struct field or a variable (FuncStores):
+ *
+ * - assignments: ops->open = foo_open, fp = &foo
+ * - variable initializers: void (*fp)(void) = foo
+ * - struct initializers, designated or not: { .open = foo_open, foo_close }
+ * - array initializers of variables: handler_t handlers[] = { a, [4] = b }
+ *
+ * Any other reference to a function that is not a call takes its address
+ * (accessAddr). The global index resolves a call through a field or variable
+ * to the functions stored into it, which are the candidate targets in the
+ * callers and callees queries (cscope, call-graph). Functions passed as
+ * arguments are not tracked.
+ */
+
+import (
+	"github.com/go-clang/v3.6/clang"
+)
+
+// funcStore is a function stored into a field or variable, located at the
+// reference to the function.
+type funcStore struct {
+	Loc    symbolLoc
+	Func   symbolID
+	Target symbolID
+}
+
+///// Parser
+
+func cursorChildren(cursor *clang.Cursor) []clang.Cursor {
+	children := []clang.Cursor{}
+	cursor.Visit(func(child, parent clang.Cursor) clang.ChildVisitResult {
+		children = append(children, child)
+		return clang.ChildVisit_Continue
+	})
+
+	return children
+}
+
+// funcRef returns the reference to a function in an expression, through
+// implicit and explicit casts, parentheses and &.
+func funcRef(expr clang.Cursor) (clang.Cursor, bool) {
+	switch expr.Kind() {
+	case clang.Cursor_DeclRefExpr:
+		ref := expr.Referenced()
+		return expr, ref.Kind() == clang.Cursor_FunctionDecl
+	case clang.Cursor_UnexposedExpr, clang.Cursor_ParenExpr,
+		clang.Cursor_CStyleCastExpr, clang.Cursor_UnaryOperator:
+		// the operand is the last child
+		children := cursorChildren(&expr)
+		if len(children) > 0 {
+			return funcRef(children[len(children)-1])
+		}
+	}
+
+	return expr, false
+}
+
+// insertFuncStore adds the store of the function referenced by value into
+// target, if value is a function.
+func insertFuncStore(tdb *symbolsTUDB, value, target clang.Cursor) {
+	ref, ok := funcRef(value)
+	if !ok || target.IsNull() {
+		return
+	}
+
+	fn := ref.Referenced()
+	tdb.InsertFuncStore(getSymbolFromCursor(&ref), getSymbolFromCursor(&fn),
+		getSymbolFromCursor(&target))
+}
+
+// insertAssignFuncStore handles the assignments of functions to fields and
+// variables.
+func insertAssignFuncStore(tdb *symbolsTUDB, cursor *clang.Cursor) {
+	operands := cursorChildren(cursor)
+	if len(operands) != 2 {
+		return
+	}
+
+	lhs := operands[0]
+	switch lhs.Kind() {
+	case clang.Cursor_MemberRefExpr, clang.Cursor_DeclRefExpr:
+	default:
+		return
+	}
+	if getUseAccess(&lhs, cursor) != accessWrite {
+		return
+	}
+
+	insertFuncStore(tdb, operands[1], lhs.Referenced())
+}
+
+// insertVarFuncStore handles the initializer of a function pointer variable,
+// its last child.
+func insertVarFuncStore(tdb *symbolsTUDB, cursor *clang.Cursor) {
+	children := cursorChildren(cursor)
+	if len(children) > 0 {
+		insertFuncStore(tdb, children[len(children)-1], *cursor)
+	}
+}
+
+// insertInitListFuncStores handles the initializers of structs, whose values
+// are stored into their fields, and the ones of array variables.
+func insertInitListFuncStores(tdb *symbolsTUDB, cursor, parent *clang.Cursor) {
+	typ := cursor.Type().CanonicalType()
+	switch typ.Kind() {
+	case clang.Type_ConstantArray, clang.Type_IncompleteArray:
+		if parent.Kind() != clang.Cursor_VarDecl {
+			return
+		}
+		for _, init := range cursorChildren(cursor) {
+			insertFuncStore(tdb, init, *parent)
+		}
+	case clang.Type_Record:
+		decl := typ.Declaration()
+		fields := []clang.Cursor{}
+		for _, child := range cursorChildren(&decl) {
+			if child.Kind() == clang.Cursor_FieldDecl {
+				fields = append(fields, child)
+			}
+		}
+
+		// positional initializers follow the last designated field
+		next := 0
+		for _, init := range cursorChildren(cursor) {
+			value := init
+			children := cursorChildren(&init)
+			if init.Kind() == clang.Cursor_UnexposedExpr && len(children) > 1 &&
+				children[0].Kind() == clang.Cursor_MemberRef {
+				// the last designator of .a.b = value
+				designator := children[len(children)-2]
+				value = children[len(children)-1]
+				if designator.Kind() != clang.Cursor_MemberRef {
+					continue
+				}
+				field := designator.Referenced()
+				insertFuncStore(tdb, value, field)
+				for i := range fields {
+					if fields[i].USR() == field.USR() {
+						next = i + 1
+					}
+				}
+				continue
+			}
+
+			if next < len(fields) {
+				insertFuncStore(tdb, value, fields[next])
+			}
+			next++
+		}
+	}
+}
+
+///// Indirect calls
+
+// callees returns the functions called at a call site: the callee, or the
+// functions stored into it for calls through fields and variables. If none is
+// known, the field or variable itself is returned.
+func (gi *globalIndex) callees(call callSite) []*globalSymbol {
+	callee := gi.symbols[call.Callee]
+	if callee == nil {
+		return nil
+	}
+	if callee.Kind == "function" || len(gi.storedFuncs[call.Callee]) == 0 {
+		return []*globalSymbol{callee}
+	}
+
+	callees := []*globalSymbol{}
+	for _, fid := range gi.storedFuncs[call.Callee] {
+		if fn := gi.symbols[fid]; fn != nil {
+			callees = append(callees, fn)
+		}
+	}
+
+	return callees
+}
+
+// callsTo returns the calls to a function, direct or through the fields and
+// variables it is stored into.
+func (gi *globalIndex) callsTo(sym *globalSymbol) []symbolLoc {
+	calls := []symbolLoc{}
+	for _, use := range sym.Uses {
+		if use.FuncCall {
+			calls = append(calls, use.Loc)
+		}
+	}
+	for _, tid := range gi.storedInto[sym.ID] {
+		target := gi.symbols[tid]
+		if target == nil {
+			continue
+		}
+		for _, use := range target.Uses {
+			if use.FuncCall {
+				calls = append(calls, use.Loc)
+			}
+		}
+	}
+
+	return calls
+}
@@ -0,0 +1,326 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * The symbols DB is split per translation unit, and it is only queried by
+ * location. The commands that work on the whole project (cscope, exports,
+ * reports) need the symbols merged across TUs and looked up by name instead.
+ * The global index reads every TUDB once (forEachTUDB) and merges the data of
+ * every symbolID: a header symbol is in all its includers, so the locations
+ * are deduplicated. It is built in memory for each command, never saved.
+ */
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+)
+
+type globalSymbol struct {
+	ID       symbolID
+	Name     string
+	Kind     string
+	Static   bool
+	Scope    string
+	Decls    []symbolLoc
+	DefAvail bool
+	Def      symbolLoc
+	Uses     []symbolUse
+
+	// all the definitions found (a symbol may be defined in several TUs,
+	// e.g. in different binaries) and the types of the declarations
+	Defs  []symbolLoc
+	Types map[symbolLoc]string
+}
+
+// callSite is a function call, located at the name of the callee.
+type callSite struct {
+	Loc    symbolLoc
+	Callee symbolID
+}
+
+type globalIndex struct {
+	db      *symbolsDB
+	symbols map[symbolID]*globalSymbol
+	byName  map[string][]*globalSymbol
+
+	// function definitions of every file, sorted by line
+	funcs map[fileID][]funcRange
+	calls []callSite
+
+	// direct inclusions of every file, headers included
+	includes map[fileID][]includeRef
+
+	// functions stored into every field or variable, and the reverse
+	// (see func-pointers.go)
+	storedFuncs map[symbolID][]symbolID
+	storedInto  map[symbolID][]symbolID
+}
+
+func newGlobalIndex(db *symbolsDB) (*globalIndex, error) {
+	gi := &globalIndex{
+		db:       db,
+		symbols:  make(map[symbolID]*globalSymbol),
+		byName:   make(map[string][]*globalSymbol),
+		funcs:    make(map[fileID][]funcRange),
+		includes: make(map[fileID][]includeRef),
+
+		storedFuncs: make(map[symbolID][]symbolID),
+		storedInto:  make(map[symbolID][]symbolID),
+	}
+
+	// every location belongs to a single symbol
+	seen := make(map[symbolLoc]bool)
+	seenDef := make(map[symbolLoc]bool)
+	seenFunc := make(map[symbolLoc]bool)
+	seenInclude := make(map[symbolLoc]bool)
+	seenStore := make(map[funcStore]bool)
+
+	err := db.forEachTUDB(func(tudb *symbolsTUDB) error {
+		for id, data := range tudb.SymData {
+			sym := gi.symbols[id]
+			if sym == nil {
+				sym = &globalSymbol{ID: id, Name: data.Name}
+				gi.symbols[id] = sym
+			}
+			if data.Kind != "" {
+				sym.Name = data.Name
+				sym.Kind = data.Kind
+				sym.Static = data.Static
+				sym.Scope = data.Scope
+			}
+
+			for _, decl := range data.Decls {
+				if !seen[decl] {
+					seen[decl] = true
+					sym.Decls = append(sym.Decls, decl)
+				}
+			}
+			if data.DefAvail && !sym.DefAvail {
+				sym.DefAvail = true
+				sym.Def = data.Def
+			}
+			if data.DefAvail && !seenDef[data.Def] {
+				seenDef[data.Def] = true
+				sym.Defs = append(sym.Defs, data.Def)
+			}
+			for _, def := range data.VarDefs {
+				if !seenDef[def] {
+					seenDef[def] = true
+					sym.Defs = append(sym.Defs, def)
+				}
+			}
+			for loc, typ := range data.DeclTypes {
+				if sym.Types == nil {
+					sym.Types = make(map[symbolLoc]string)
+				}
+				sym.Types[loc] = typ
+			}
+			for _, use := range data.Uses {
+				if !seen[use.Loc] {
+					seen[use.Loc] = true
+					sym.Uses = append(sym.Uses, use)
+				}
+			}
+		}
+
+		for _, fn := range tudb.Funcs {
+			if !seenFunc[fn.Start] {
+				seenFunc[fn.Start] = true
+				gi.funcs[fn.Start.File] = append(gi.funcs[fn.Start.File], fn)
+			}
+		}
+
+		for _, incl := range tudb.Includes {
+			if !seenInclude[incl.Loc] {
+				seenInclude[incl.Loc] = true
+				gi.includes[incl.Loc.File] = append(gi.includes[incl.Loc.File], incl)
+			}
+		}
+
+		for _, store := range tudb.FuncStores {
+			if seenStore[store] {
+				continue
+			}
+			seenStore[store] = true
+			if !containsID(gi.storedFuncs[store.Target], store.Func) {
+				gi.storedFuncs[store.Target] = append(gi.storedFuncs[store.Target], store.Func)
+				gi.storedInto[store.Func] = append(gi.storedInto[store.Func], store.Target)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sym := range gi.symbols {
+		gi.byName[sym.Name] = append(gi.byName[sym.Name], sym)
+		for _, use := range sym.Uses {
+			if use.FuncCall {
+				gi.calls = append(gi.calls, callSite{use.Loc, sym.ID})
+			}
+		}
+	}
+	for _, funcs := range gi.funcs {
+		sort.Slice(funcs, func(i, j int) bool {
+			return funcs[i].Start.Line < funcs[j].Start.Line
+		})
+	}
+
+	return gi, nil
+}
+
+func containsID(ids []symbolID, id symbolID) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openGlobalIndex opens the DB in dbDir and builds its global index.
+func openGlobalIndex(dbDir string) (*globalIndex, error) {
+	db, err := openSymbolsDB(dbDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return newGlobalIndex(db)
+}
+
+// estimateSize returns an approximation of the memory used by the index, in
+// the same units as the one of TUDBs (see symbolsTUDB.estimateSize).
+func (gi *globalIndex) estimateSize() int64 {
+	size := tudbBaseSize
+	for _, sym := range gi.symbols {
+		size += symDataEntrySize + int64(len(sym.Name)+len(sym.Scope))
+		size += int64(len(sym.Uses)) * symUseSize
+		size += int64(len(sym.Decls)+len(sym.Defs)+len(sym.Types)) * symDeclSize
+	}
+	size += int64(len(gi.byName)) * symLocEntrySize
+	for _, funcs := range gi.funcs {
+		size += fileEntrySize + int64(len(funcs))*symDeclSize
+	}
+	for _, includes := range gi.includes {
+		size += fileEntrySize + int64(len(includes))*symDeclSize
+	}
+	size += int64(len(gi.calls)) * symUseSize
+	for _, ids := range gi.storedFuncs {
+		size += symLocEntrySize + int64(len(ids))*symDeclSize
+	}
+	for _, ids := range gi.storedInto {
+		size += symLocEntrySize + int64(len(ids))*symDeclSize
+	}
+
+	return size
+}
+
+// path returns the path of a file, or an empty string if it is not in the DB.
+func (gi *globalIndex) path(fid fileID) string {
+	cache := gi.db.TUDBs[fid]
+	if cache == nil {
+		return ""
+	}
+
+	return cache.Path
+}
+
+// files returns the paths of the existing files in the DB, sorted.
+func (gi *globalIndex) files() []string {
+	files := []string{}
+	for file := range gi.db.GetSetFilesInDB() {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	return files
+}
+
+// enclosingFunc returns the function defined around loc, or nil.
+func (gi *globalIndex) enclosingFunc(loc symbolLoc) *globalSymbol {
+	funcs := gi.funcs[loc.File]
+	i := sort.Search(len(funcs), func(i int) bool {
+		return funcs[i].Start.Line > loc.Line
+	})
+	if i == 0 || funcs[i-1].End < loc.Line {
+		return nil
+	}
+
+	return gi.symbols[funcs[i-1].ID]
+}
+
+// funcRangeOf returns the extent of the definition of a function, or nil.
+func (gi *globalIndex) funcRangeOf(sym *globalSymbol) *funcRange {
+	if !sym.DefAvail {
+		return nil
+	}
+
+	for i, fn := range gi.funcs[sym.Def.File] {
+		if fn.Start == sym.Def {
+			return &gi.funcs[sym.Def.File][i]
+		}
+	}
+
+	return nil
+}
+
+// lookupName returns the symbols named pattern. A pattern with regular
+// expression metacharacters matches the whole name.
+func (gi *globalIndex) lookupName(pattern string) ([]*globalSymbol, error) {
+	if regexp.QuoteMeta(pattern) == pattern {
+		return gi.byName[pattern], nil
+	}
+
+	re, err := regexp.Compile("^(" + pattern + ")$")
+	if err != nil {
+		return nil, err
+	}
+
+	syms := []*globalSymbol{}
+	for name, named := range gi.byName {
+		if re.MatchString(name) {
+			syms = append(syms, named...)
+		}
+	}
+
+	return syms, nil
+}
+
+// matchPath checks if path matches a file pattern: a path suffix, a base name
+// or a glob on any of them.
+func matchPath(pattern, path string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	path = filepath.ToSlash(path)
+	if path == pattern || filepath.Base(path) == pattern ||
+		len(path) > len(pattern) && path[len(path)-len(pattern)-1:] == "/"+pattern {
+		return true
+	}
+	if ok, _ := filepath.Match(pattern, path); ok {
+		return true
+	}
+	ok, _ := filepath.Match(pattern, filepath.Base(path))
+
+	return ok
+}
@@ -0,0 +1,364 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * The include-graph and call-graph commands write the include dependencies
+ * and the calls between functions as Graphviz DOT or JSON. They read the DB
+ * directory, so the daemon does not need to be running:
+ *
+ *   $ navc include-graph -root src/main.c -depth 2 | dot -Tsvg > incl.svg
+ *   $ navc call-graph -root main -filter src/ -format json
+ *
+ * The include graph has an edge for every #include, from the including file
+ * (a TU or a header) to the included header. The call graph has an edge from
+ * every function to the functions it calls, found from the uses that are
+ * function calls and the function enclosing them. Calls through function
+ * pointers have an edge to every function stored into them.
+ *
+ * Without -root, the whole graph is written. With roots (file paths or function
+ * names), only the nodes reachable from them, up to -depth edges away, are.
+ * With -reverse, the edges are followed backwards, e.g. to get all the callers
+ * of a function. Nodes can be filtered by file: -filter keeps only the nodes in
+ * the given directories or matching the given patterns, and -exclude drops
+ * them.
+ */
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type graphNode struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	File  string `json:"file,omitempty"`
+}
+
+type graphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type graph struct {
+	Name  string      `json:"name"`
+	Nodes []graphNode `json:"nodes"`
+	Edges []graphEdge `json:"edges"`
+}
+
+type graphBuilder struct {
+	name  string
+	nodes map[string]graphNode
+	out   map[string]map[string]bool
+	in    map[string]map[string]bool
+}
+
+type graphOptions struct {
+	roots   []string
+	depth   int
+	reverse bool
+	filter  []string
+	exclude []string
+}
+
+func newGraphBuilder(name string) *graphBuilder {
+	return &graphBuilder{
+		name:  name,
+		nodes: make(map[string]graphNode),
+		out:   make(map[string]map[string]bool),
+		in:    make(map[string]map[string]bool),
+	}
+}
+
+func (gb *graphBuilder) addEdge(from, to graphNode) {
+	gb.nodes[from.ID] = from
+	gb.nodes[to.ID] = to
+
+	if gb.out[from.ID] == nil {
+		gb.out[from.ID] = make(map[string]bool)
+	}
+	gb.out[from.ID][to.ID] = true
+	if gb.in[to.ID] == nil {
+		gb.in[to.ID] = make(map[string]bool)
+	}
+	gb.in[to.ID][from.ID] = true
+}
+
+// matchFileFilter checks if file is in the directory or matches the pattern.
+func matchFileFilter(pattern, file string) bool {
+	return isUnderDir(file, pattern) || matchPath(pattern, file)
+}
+
+func (opts *graphOptions) keep(node graphNode) bool {
+	for _, pattern := range opts.exclude {
+		if matchFileFilter(pattern, node.File) {
+			return false
+		}
+	}
+	if len(opts.filter) == 0 {
+		return true
+	}
+	for _, pattern := range opts.filter {
+		if matchFileFilter(pattern, node.File) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// build returns the graph with the nodes kept by the options and reachable
+// from the roots, if any.
+func (gb *graphBuilder) build(roots []string, opts *graphOptions) *graph {
+	next := gb.out
+	if opts.reverse {
+		next = gb.in
+	}
+
+	included := map[string]bool{}
+	edges := []graphEdge{}
+	addEdge := func(from, to string) {
+		if opts.reverse {
+			from, to = to, from
+		}
+		edges = append(edges, graphEdge{from, to})
+	}
+
+	if len(opts.roots) == 0 {
+		for id, node := range gb.nodes {
+			included[id] = opts.keep(node)
+		}
+		for from, tos := range gb.out {
+			for to := range tos {
+				if included[from] && included[to] {
+					edges = append(edges, graphEdge{from, to})
+				}
+			}
+		}
+	} else {
+		// breadth first from the roots
+		dist := map[string]int{}
+		queue := []string{}
+		for _, root := range roots {
+			if node, exist := gb.nodes[root]; exist && opts.keep(node) {
+				if _, seen := dist[root]; !seen {
+					dist[root] = 0
+					queue = append(queue, root)
+				}
+			}
+		}
+		for len(queue) > 0 {
+			id := queue[0]
+			queue = queue[1:]
+			included[id] = true
+			if opts.depth > 0 && dist[id] >= opts.depth {
+				continue
+			}
+
+			for nextID := range next[id] {
+				if !opts.keep(gb.nodes[nextID]) {
+					continue
+				}
+				addEdge(id, nextID)
+				if _, seen := dist[nextID]; !seen {
+					dist[nextID] = dist[id] + 1
+					queue = append(queue, nextID)
+				}
+			}
+		}
+	}
+
+	g := &graph{Name: gb.name, Nodes: []graphNode{}, Edges: edges}
+	for id := range included {
+		if included[id] {
+			g.Nodes = append(g.Nodes, gb.nodes[id])
+		}
+	}
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		return g.Nodes[i].Label < g.Nodes[j].Label
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+
+	return g
+}
+
+func (g *graph) writeDOT(w io.Writer) error {
+	fmt.Fprintf(w, "digraph %s {\n", strconv.Quote(g.Name))
+	for _, node := range g.Nodes {
+		fmt.Fprintf(w, "\t%s [label=%s];\n", strconv.Quote(node.ID),
+			strconv.Quote(node.Label))
+	}
+	for _, edge := range g.Edges {
+		fmt.Fprintf(w, "\t%s -> %s;\n", strconv.Quote(edge.From),
+			strconv.Quote(edge.To))
+	}
+	_, err := fmt.Fprintf(w, "}\n")
+
+	return err
+}
+
+func (g *graph) write(w io.Writer, format string) error {
+	switch format {
+	case "dot":
+		return g.writeDOT(w)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	}
+
+	return fmt.Errorf("unknown graph format %q", format)
+}
+
+///// Include and call graphs
+
+func fileNode(gi *globalIndex, fid fileID) graphNode {
+	path := gi.path(fid)
+	label := path
+	if strings.HasPrefix(label, nonExistingHeaderPrefix) {
+		label = "<not found> " + strings.TrimPrefix(label, nonExistingHeaderPrefix)
+	}
+
+	return graphNode{ID: path, Label: label, File: path}
+}
+
+func includeGraph(gi *globalIndex) *graphBuilder {
+	gb := newGraphBuilder("include")
+	for fid, includes := range gi.includes {
+		if gi.path(fid) == "" {
+			continue
+		}
+		for _, incl := range includes {
+			if gi.path(incl.Header) == "" {
+				continue
+			}
+			gb.addEdge(fileNode(gi, fid), fileNode(gi, incl.Header))
+		}
+	}
+
+	return gb
+}
+
+func funcNode(gi *globalIndex, sym *globalSymbol) graphNode {
+	file := ""
+	if sym.DefAvail {
+		file = gi.path(sym.Def.File)
+	} else if len(sym.Decls) > 0 {
+		file = gi.path(sym.Decls[0].File)
+	}
+
+	return graphNode{ID: hex.EncodeToString(sym.ID[:]), Label: sym.Name, File: file}
+}
+
+func callGraph(gi *globalIndex) *graphBuilder {
+	gb := newGraphBuilder("call")
+	for _, call := range gi.calls {
+		caller := gi.enclosingFunc(call.Loc)
+		if caller == nil {
+			continue
+		}
+		for _, callee := range gi.callees(call) {
+			gb.addEdge(funcNode(gi, caller), funcNode(gi, callee))
+		}
+	}
+
+	return gb
+}
+
+// graphCmd runs the include-graph and call-graph commands.
+func graphCmd(kind string, args []string) error {
+	fs := flag.NewFlagSet(kind+"-graph", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	format := fs.String("format", "dot", "Output format: dot or json")
+	out := fs.String("o", "", "Path of the output (default stdout)")
+	opts := &graphOptions{}
+	fs.Var((*stringList)(&opts.roots), "root",
+		"File (include graph) or function (call graph) to start from, can be repeated")
+	fs.IntVar(&opts.depth, "depth", 0, "Maximum depth from the roots (0 = no limit)")
+	fs.BoolVar(&opts.reverse, "reverse", false,
+		"Follow the edges backwards (includers or callers)")
+	fs.Var((*stringList)(&opts.filter), "filter",
+		"Keep only nodes in this directory or matching this pattern, can be repeated")
+	fs.Var((*stringList)(&opts.exclude), "exclude",
+		"Drop nodes in this directory or matching this pattern, can be repeated")
+	fs.Parse(args)
+
+	gi, err := openGlobalIndex(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	var gb *graphBuilder
+	roots := []string{}
+	switch kind {
+	case "include":
+		gb = includeGraph(gi)
+		for _, root := range opts.roots {
+			for _, file := range gi.files() {
+				if matchPath(root, file) {
+					roots = append(roots, file)
+				}
+			}
+		}
+	case "call":
+		gb = callGraph(gi)
+		for _, root := range opts.roots {
+			syms, err := gi.lookupName(root)
+			if err != nil {
+				return err
+			}
+			for _, sym := range syms {
+				roots = append(roots, funcNode(gi, sym).ID)
+			}
+		}
+	}
+	if len(opts.roots) > 0 && len(roots) == 0 {
+		return fmt.Errorf("roots not found: %s", strings.Join(opts.roots, ", "))
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return gb.build(roots, opts).write(w, *format)
+}
+
+func includeGraphCmd(args []string) error {
+	return graphCmd("include", args)
+}
+
+func callGraphCmd(args []string) error {
+	return graphCmd("call", args)
+}
@@ -0,0 +1,331 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Ignore rules decide which files and directories are not indexed nor watched.
+ * They use the gitignore syntax and are read from (in order of precedence,
+ * lowest first):
+ *
+ * 1. The .gitignore file of every directory, if enabled (-gitignore).
+ * 2. The .navcignore file of every directory.
+ * 3. The -exclude flags.
+ * 4. The -include flags. These are negated patterns, so they re-include files
+ *    excluded by any of the above, but not inside an excluded directory.
+ *
+ * As in git, the patterns of an ignore file are relative to its directory, and
+ * the files of a subdirectory take precedence over the ones of its parents.
+ * The files of the index directories are read when the rules are created, and
+ * the ones of their subdirectories while walking the tree (LoadDir). The flags
+ * are relative to every index directory.
+ *
+ * The last matching pattern wins, patterns without a slash match at any level,
+ * and a file inside an ignored directory is ignored: the directory is not
+ * walked, so no pattern can re-include it. To index some files of a directory,
+ * exclude its contents (dir/*) instead of the directory.
+ */
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+type ignoreRules struct {
+	// directory the patterns are relative to
+	base  string
+	rules []ignoreRule
+}
+
+type ignoreMatcher struct {
+	sync.RWMutex
+	gitignore bool
+
+	// rules of the ignore files, parents first, and of the flags
+	sets  []*ignoreRules
+	flags []*ignoreRules
+}
+
+// globToRegexp translates a gitignore glob to a regular expression.
+func globToRegexp(glob string) string {
+	re := ""
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// any number of directories
+					i++
+					re += "(.*/)?"
+				} else {
+					re += ".*"
+				}
+			} else {
+				re += "[^/]*"
+			}
+		case '?':
+			re += "[^/]"
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				re += `\[`
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re += "[" + strings.Replace(class, `\`, `\\`, -1) + "]"
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				re += regexp.QuoteMeta(glob[i : i+1])
+			}
+		default:
+			re += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+
+	return re
+}
+
+func parseIgnoreRule(line string) (*ignoreRule, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || line[0] == '#' {
+		return nil, nil
+	}
+
+	rule := &ignoreRule{}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	re := ""
+	if strings.Contains(line, "/") {
+		// relative to the base directory
+		re = "^" + globToRegexp(strings.TrimLeft(line, "/")) + "$"
+	} else {
+		re = "^(.*/)?" + globToRegexp(line) + "$"
+	}
+
+	var err error
+	rule.re, err = regexp.Compile(re)
+	if err != nil {
+		return nil, err
+	}
+
+	return rule, nil
+}
+
+func (ir *ignoreRules) addPatterns(patterns []string, negate bool) error {
+	for _, pattern := range patterns {
+		if negate {
+			pattern = "!" + pattern
+		}
+
+		rule, err := parseIgnoreRule(pattern)
+		if err != nil {
+			return err
+		}
+		if rule != nil {
+			ir.rules = append(ir.rules, *rule)
+		}
+	}
+
+	return nil
+}
+
+func (ir *ignoreRules) addFile(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		patterns = append(patterns, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return ir.addPatterns(patterns, false)
+}
+
+func newIgnoreMatcher(indexDir []string, gitignore bool, exclude, include []string) (*ignoreMatcher, error) {
+	im := &ignoreMatcher{gitignore: gitignore}
+
+	for _, dir := range indexDir {
+		err := im.LoadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		ir := &ignoreRules{base: filepath.Clean(dir)}
+		err = ir.addPatterns(exclude, false)
+		if err != nil {
+			return nil, err
+		}
+		err = ir.addPatterns(include, true)
+		if err != nil {
+			return nil, err
+		}
+
+		im.flags = append(im.flags, ir)
+	}
+
+	return im, nil
+}
+
+// LoadDir reads the ignore files of a directory, replacing its rules if they
+// were already read.
+func (im *ignoreMatcher) LoadDir(dir string) error {
+	if im == nil {
+		return nil
+	}
+
+	ir := &ignoreRules{base: filepath.Clean(dir)}
+	if im.gitignore {
+		err := ir.addFile(filepath.Join(dir, ".gitignore"))
+		if err != nil {
+			return err
+		}
+	}
+	err := ir.addFile(filepath.Join(dir, ".navcignore"))
+	if err != nil {
+		return err
+	}
+
+	im.Lock()
+	defer im.Unlock()
+
+	sets := []*ignoreRules{}
+	for _, other := range im.sets {
+		if other.base != ir.base {
+			sets = append(sets, other)
+		}
+	}
+	if len(ir.rules) > 0 {
+		sets = append(sets, ir)
+	}
+	// the directories of the rules matching a path are its ancestors, so
+	// the shorter ones are the parents
+	sort.SliceStable(sets, func(i, j int) bool {
+		return len(sets[i].base) < len(sets[j].base)
+	})
+	im.sets = sets
+
+	return nil
+}
+
+// match applies the rules to path, if under their base directory, and returns
+// whether it is ignored after them.
+func (ir *ignoreRules) match(path string, isDir, ignored bool) bool {
+	rel, err := filepath.Rel(ir.base, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ignored
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, rule := range ir.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// match checks the rules for path only, without looking at its parent
+// directories. This is enough while walking a tree, as ignored directories are
+// skipped.
+func (im *ignoreMatcher) match(path string, isDir bool) bool {
+	if im == nil {
+		return false
+	}
+
+	im.RLock()
+	defer im.RUnlock()
+
+	ignored := false
+	for _, ir := range im.sets {
+		ignored = ir.match(path, isDir, ignored)
+	}
+	for _, ir := range im.flags {
+		ignored = ir.match(path, isDir, ignored)
+	}
+
+	return ignored
+}
+
+// replace sets the rules of other, e.g. after reloading the ignore files. It
+// returns a matcher with the previous rules.
+func (im *ignoreMatcher) replace(other *ignoreMatcher) *ignoreMatcher {
+	im.Lock()
+	defer im.Unlock()
+
+	old := &ignoreMatcher{gitignore: im.gitignore, sets: im.sets, flags: im.flags}
+	im.gitignore = other.gitignore
+	im.sets = other.sets
+	im.flags = other.flags
+
+	return old
+}
+
+// Ignored checks if path, or any of its parent directories, is ignored.
+func (im *ignoreMatcher) Ignored(path string, isDir bool) bool {
+	if im == nil {
+		return false
+	}
+
+	path = filepath.Clean(path)
+	for dir := filepath.Dir(path); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if im.match(dir, true) {
+			return true
+		}
+	}
+
+	return im.match(path, isDir)
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Include-what-you-use style analysis. Every use of a symbol in a file is
+ * attributed to the files providing the symbol: the ones with a declaration or
+ * the definition of it (providers). With the include graph of the TU:
+ *
+ * - An #include is unused if neither the header nor the headers it includes
+ *   provide any symbol used in the file. Headers providing no symbol known to
+ *   the DB (e.g. external headers not indexed) are never reported, nor are the
+ *   headers only needed for macros in #if conditions, as those are not uses.
+ * - A symbol is missing an #include if it is used in a file, it is not
+ *   provided by the file itself nor by a header it includes directly, but by a
+ *   header it includes transitively.
+ *
+ * The analysis of a file is done on the TUDB of a single TU (for headers, the
+ * context TU or the first includer), as a header may include different files
+ * depending on the TU. The GetIncludeReport request returns the report of a
+ * file, and the include-report command the one of the whole project:
+ *
+ *   $ navc include-report -format json src/
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// UnusedInclude is an #include at Line of a header providing no used symbol.
+type UnusedInclude struct {
+	Line   int
+	Header string
+}
+
+// MissingInclude is the first use of Symbol in a file, provided by Header,
+// which is only included transitively.
+type MissingInclude struct {
+	Line   int
+	Col    int
+	Symbol string
+	Header string
+}
+
+// IncludeReport is the result of the include analysis of File.
+type IncludeReport struct {
+	File    string
+	Unused  []UnusedInclude
+	Missing []MissingInclude
+}
+
+// symbolProviders returns the files declaring or defining a symbol.
+func symbolProviders(data *symbolData) map[fileID]bool {
+	providers := make(map[fileID]bool)
+	for _, decl := range data.Decls {
+		providers[decl.File] = true
+	}
+	if data.DefAvail {
+		providers[data.Def.File] = true
+	}
+
+	return providers
+}
+
+// includeClosure returns the files reachable from fid in the include graph,
+// fid included.
+func includeClosure(graph map[fileID][]includeRef, fid fileID) map[fileID]bool {
+	closure := map[fileID]bool{fid: true}
+	queue := []fileID{fid}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for _, incl := range graph[cur] {
+			if !closure[incl.Header] {
+				closure[incl.Header] = true
+				queue = append(queue, incl.Header)
+			}
+		}
+	}
+
+	return closure
+}
+
+func intersects(a, b map[fileID]bool) bool {
+	for fid := range a {
+		if b[fid] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func missingBefore(a, b *MissingInclude) bool {
+	if a.Line != b.Line {
+		return a.Line < b.Line
+	}
+	return a.Col < b.Col
+}
+
+// includeReport analyses the includes of the file fileSha1 in tudb.
+func (db *symbolsDB) includeReport(tudb *symbolsTUDB, fileSha1 fileID) *IncludeReport {
+	report := &IncludeReport{
+		File:    db.TUDBs[fileSha1].Path,
+		Unused:  []UnusedInclude{},
+		Missing: []MissingInclude{},
+	}
+
+	graph := includeGraphOf(tudb)
+	reachable := includeClosure(graph, fileSha1)
+	direct := graph[fileSha1]
+	closures := make([]map[fileID]bool, len(direct))
+	directSet := make(map[fileID]bool)
+	for i, incl := range direct {
+		closures[i] = includeClosure(graph, incl.Header)
+		directSet[incl.Header] = true
+	}
+
+	providing := make(map[fileID]bool)
+	used := make([]bool, len(direct))
+	missing := make(map[string]MissingInclude)
+	for _, data := range tudb.SymData {
+		providers := symbolProviders(&data)
+		for fid := range providers {
+			providing[fid] = true
+		}
+		if len(providers) == 0 || providers[fileSha1] {
+			continue
+		}
+
+		for _, use := range data.Uses {
+			if use.Loc.File != fileSha1 {
+				continue
+			}
+
+			for i := range direct {
+				used[i] = used[i] || intersects(closures[i], providers)
+			}
+			if intersects(directSet, providers) {
+				continue
+			}
+
+			// provided only by headers included transitively
+			header := ""
+			for fid := range providers {
+				cache := db.TUDBs[fid]
+				if reachable[fid] && cache != nil &&
+					(header == "" || cache.Path < header) {
+					header = cache.Path
+				}
+			}
+			if header == "" {
+				continue
+			}
+			miss := MissingInclude{
+				Line:   int(use.Loc.Line),
+				Col:    int(use.Loc.Col),
+				Symbol: data.Name,
+				Header: header,
+			}
+			if first, seen := missing[data.Name]; !seen || missingBefore(&miss, &first) {
+				missing[data.Name] = miss
+			}
+		}
+	}
+
+	for i, incl := range direct {
+		cache := db.TUDBs[incl.Header]
+		if used[i] || cache == nil || !intersects(closures[i], providing) {
+			continue
+		}
+		report.Unused = append(report.Unused, UnusedInclude{
+			Line:   int(incl.Loc.Line),
+			Header: cache.Path,
+		})
+	}
+	for _, miss := range missing {
+		report.Missing = append(report.Missing, miss)
+	}
+	sort.Slice(report.Unused, func(i, j int) bool {
+		return report.Unused[i].Line < report.Unused[j].Line
+	})
+	sort.Slice(report.Missing, func(i, j int) bool {
+		return missingBefore(&report.Missing[i], &report.Missing[j])
+	})
+
+	return report
+}
+
+// IncludeReportOf returns the include analysis of a file. Direct is ignored.
+func (db *symbolsDB) IncludeReportOf(query *IncludeQuery) (*IncludeReport, error) {
+	tudb, err := db.includerTUDB(query.File, query.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	return db.includeReport(tudb, getStringEncode(filepath.Clean(query.File))), nil
+}
+
+///// include-report command
+
+// projectIncludeReport returns the reports with findings of the files matching
+// the patterns, or of all the files if none. Every file is analysed in the
+// first TU having it.
+func projectIncludeReport(db *symbolsDB, patterns []string) ([]*IncludeReport, error) {
+	reports := []*IncludeReport{}
+	done := make(map[fileID]bool)
+	keep := func(fid fileID) bool {
+		cache := db.TUDBs[fid]
+		if done[fid] || cache == nil {
+			return false
+		}
+		done[fid] = true
+		if len(patterns) == 0 {
+			return true
+		}
+		for _, pattern := range patterns {
+			if matchFileFilter(pattern, cache.Path) {
+				return true
+			}
+		}
+		return false
+	}
+
+	err := db.forEachTUDB(func(tudb *symbolsTUDB) error {
+		if len(tudb.Includes) == 0 && len(tudb.SymData) == 0 {
+			// header record
+			return nil
+		}
+
+		files := []fileID{getStringEncode(tudb.File)}
+		for _, incl := range tudb.Includes {
+			files = append(files, incl.Header)
+		}
+		for _, fid := range files {
+			if !keep(fid) {
+				continue
+			}
+			report := db.includeReport(tudb, fid)
+			if len(report.Unused) > 0 || len(report.Missing) > 0 {
+				reports = append(reports, report)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].File < reports[j].File
+	})
+
+	return reports, nil
+}
+
+func writeIncludeReport(w io.Writer, reports []*IncludeReport, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(reports)
+	case "text":
+		for _, report := range reports {
+			for _, unused := range report.Unused {
+				fmt.Fprintf(w, "%s:%d: unused include %s\n",
+					report.File, unused.Line, unused.Header)
+			}
+			for _, miss := range report.Missing {
+				fmt.Fprintf(w, "%s:%d:%d: %s is from %s, not included directly\n",
+					report.File, miss.Line, miss.Col, miss.Symbol,
+					miss.Header)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// includeReportCmd runs the include-report command. The arguments are the
+// directories or file patterns to report, all files by default.
+func includeReportCmd(args []string) error {
+	fs := flag.NewFlagSet("include-report", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	format := fs.String("format", "text", "Output format: text or json")
+	fs.Parse(args)
+
+	db, err := openSymbolsDB(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	reports, err := projectIncludeReport(db, fs.Args())
+	if err != nil {
+		return err
+	}
+
+	return writeIncludeReport(os.Stdout, reports, *format)
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Include graph queries of the daemon. Every TUDB has the inclusion directives
+ * of the TU and of all the headers it includes (Includes), so the include graph
+ * as seen by a TU is in its TUDB alone. Headers do not have their own
+ * directives, they are taken from one of their includers: the context TU, if
+ * given, or the first one (see sortedIncluders). A header may include
+ * different files depending on the macros of the TU.
+ *
+ * - IncludersOf: the TUs including a header (Includers), or, if direct, the
+ *   files (TUs or headers) with an #include of the header.
+ * - IncludeesOf: the headers included by a file, directly or not.
+ * - IncludeChain: the chain of #include directives from a TU to a header,
+ *   explaining why the header is included. It is one of the shortest chains.
+ *
+ * The definition of an #include line is the header it includes (includeAt,
+ * includeTarget), whatever the column. If the header was not found, the error
+ * has the search paths of the TU (SearchPaths) that were tried.
+ */
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// IncludeQuery is the input of the includers and includees requests. Context
+// is optional, it is the TU used to get the directives of headers.
+type IncludeQuery struct {
+	File    string
+	Direct  bool
+	Context string
+}
+
+// IncludeChainQuery asks why Header is included in the TU File.
+type IncludeChainQuery struct {
+	File   string
+	Header string
+}
+
+// IncludeStep is an #include directive of a chain: File includes Header at
+// Line.
+type IncludeStep struct {
+	File   string
+	Line   int
+	Header string
+}
+
+// includeGraphOf returns the direct inclusions of every file in a TU.
+func includeGraphOf(tudb *symbolsTUDB) map[fileID][]includeRef {
+	graph := make(map[fileID][]includeRef)
+	for _, incl := range tudb.Includes {
+		graph[incl.Loc.File] = append(graph[incl.Loc.File], incl)
+	}
+
+	return graph
+}
+
+// includerTUDB returns the TUDB with the include graph of file: its own for a
+// TU, or the one of an includer for a header.
+func (db *symbolsDB) includerTUDB(file, context string) (*symbolsTUDB, error) {
+	tudb, err := db.GetSymbolsTUDB(getStringEncode(filepath.Clean(file)))
+	if err != nil {
+		return nil, err
+	}
+	if len(tudb.Includers) == 0 {
+		return tudb, nil
+	}
+
+	for _, fid := range db.sortedIncluders(tudb.Includers, context) {
+		itudb, err := db.GetSymbolsTUDB(fid)
+		if err == nil {
+			return itudb, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No includer found")
+}
+
+// sortedPaths returns the paths of a set of files, sorted.
+func (db *symbolsDB) sortedPaths(fids map[fileID]bool) []string {
+	paths := []string{}
+	for fid := range fids {
+		if cache := db.TUDBs[fid]; cache != nil {
+			paths = append(paths, cache.Path)
+		}
+	}
+	sort.Strings(paths)
+
+	return paths
+}
+
+// IncludersOf returns the TUs including a header, or the files with an
+// #include of it if Direct is set.
+func (db *symbolsDB) IncludersOf(query *IncludeQuery) ([]string, error) {
+	headerSha1 := getStringEncode(filepath.Clean(query.File))
+	htudb, err := db.GetSymbolsTUDB(headerSha1)
+	if err != nil {
+		return nil, err
+	}
+
+	if !query.Direct {
+		return db.sortedPaths(htudb.Includers), nil
+	}
+
+	direct := map[fileID]bool{}
+	for fid := range htudb.Includers {
+		tudb, err := db.GetSymbolsTUDB(fid)
+		if err != nil {
+			continue
+		}
+		for _, incl := range tudb.Includes {
+			if incl.Header == headerSha1 {
+				direct[incl.Loc.File] = true
+			}
+		}
+	}
+
+	return db.sortedPaths(direct), nil
+}
+
+// IncludeesOf returns the headers included by a file, or only the ones with
+// an #include in it if Direct is set.
+func (db *symbolsDB) IncludeesOf(query *IncludeQuery) ([]string, error) {
+	tudb, err := db.includerTUDB(query.File, query.Context)
+	if err != nil {
+		return nil, err
+	}
+	graph := includeGraphOf(tudb)
+	fileSha1 := getStringEncode(filepath.Clean(query.File))
+
+	includees := map[fileID]bool{}
+	queue := []fileID{fileSha1}
+	for len(queue) > 0 {
+		fid := queue[0]
+		queue = queue[1:]
+
+		for _, incl := range graph[fid] {
+			if includees[incl.Header] {
+				continue
+			}
+			includees[incl.Header] = true
+			if !query.Direct {
+				queue = append(queue, incl.Header)
+			}
+		}
+	}
+
+	return db.sortedPaths(includees), nil
+}
+
+// IncludeChain returns the #include directives that include Header in File.
+func (db *symbolsDB) IncludeChain(query *IncludeChainQuery) ([]IncludeStep, error) {
+	tudb, err := db.GetSymbolsTUDB(getStringEncode(filepath.Clean(query.File)))
+	if err != nil {
+		return nil, err
+	}
+	graph := includeGraphOf(tudb)
+	fileSha1 := getStringEncode(tudb.File)
+	headerSha1 := getStringEncode(filepath.Clean(query.Header))
+
+	// breadth first, keeping the directive that reached every header
+	reachedBy := map[fileID]includeRef{}
+	found := false
+	queue := []fileID{fileSha1}
+	for len(queue) > 0 && !found {
+		fid := queue[0]
+		queue = queue[1:]
+
+		for _, incl := range graph[fid] {
+			if _, seen := reachedBy[incl.Header]; seen || incl.Header == fileSha1 {
+				continue
+			}
+			reachedBy[incl.Header] = incl
+			queue = append(queue, incl.Header)
+			found = found || incl.Header == headerSha1
+		}
+	}
+
+	if !found {
+		return nil, fmt.Errorf("Header not included")
+	}
+
+	chain := []IncludeStep{}
+	for fid := headerSha1; fid != fileSha1; {
+		incl := reachedBy[fid]
+		from, to := db.TUDBs[incl.Loc.File], db.TUDBs[incl.Header]
+		if from == nil || to == nil {
+			return nil, fmt.Errorf("File not in DB")
+		}
+		chain = append([]IncludeStep{{
+			File:   from.Path,
+			Line:   int(incl.Loc.Line),
+			Header: to.Path,
+		}}, chain...)
+		fid = incl.Loc.File
+	}
+
+	return chain, nil
+}
+
+// includeAt returns the inclusion directive in the line of req, and the TUDB
+// where it was found, or nil if the line has none.
+func (db *symbolsDB) includeAt(req *SymbolLocReq, context string) (*symbolsTUDB, *includeRef) {
+	fileSha1 := getStringEncode(filepath.Clean(req.File))
+	if db.TUDBs[fileSha1] == nil {
+		return nil, nil
+	}
+
+	tudb, err := db.includerTUDB(req.File, context)
+	if err != nil {
+		return nil, nil
+	}
+	for i, incl := range tudb.Includes {
+		if incl.Loc.File == fileSha1 && int(incl.Loc.Line) == req.Line {
+			return tudb, &tudb.Includes[i]
+		}
+	}
+
+	return nil, nil
+}
+
+// includeTarget returns the location of the header included by incl.
+func (db *symbolsDB) includeTarget(tudb *symbolsTUDB, incl *includeRef) (*SymbolLocReq, error) {
+	cache := db.TUDBs[incl.Header]
+	if cache == nil {
+		return nil, fmt.Errorf("Header %s not in DB", incl.Name)
+	}
+	if strings.HasPrefix(cache.Path, nonExistingHeaderPrefix) {
+		return nil, fmt.Errorf("Header %s not found in: %s", incl.Name,
+			strings.Join(tudb.SearchPaths, ", "))
+	}
+
+	return &SymbolLocReq{
+		File:     cache.Path,
+		Line:     1,
+		Col:      1,
+		External: db.ext.IsExternal(cache.Path),
+	}, nil
+}
@@ -21,18 +21,55 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"runtime"
+	"strings"
 )
 
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ",")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
+// commands run instead of the daemon when given as first argument, e.g.
+// navc export-bundle -o sdk.navcb
+var commands = map[string]func(args []string) error{
+	"export-bundle":  exportBundleCmd,
+	"tags":           tagsCmd,
+	"cscope":         cscopeCmd,
+	"export":         exportCmd,
+	"include-graph":  includeGraphCmd,
+	"call-graph":     callGraphCmd,
+	"include-report": includeReportCmd,
+	"dead-code":      deadCodeCmd,
+	"odr-check":      odrCheckCmd,
+}
+
 func main() {
-	// path to symbols DB
-	var dbDir string
-	flag.StringVar(&dbDir, "db", ".navc_dbsymbols", "Path to symbols DB dir")
+	if len(os.Args) > 1 {
+		if cmd, exist := commands[os.Args[1]]; exist {
+			err := cmd(os.Args[2:])
+			if err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	// settings that can also be in the configuration file
+	flagCfg := defaultConfig()
+	registerConfigFlags(flagCfg)
 
-	// number of parallel indexing threads
-	var nIndexingThreads int
-	flag.IntVar(&nIndexingThreads, "numThreads", runtime.NumCPU(),
-		"Number of indexing threads")
+	// path to the project configuration file
+	var cfgFile string
+	flag.StringVar(&cfgFile, "config", defaultConfigFile,
+		"Path to the project configuration file")
 
 	// reset DB
 	var resetDB bool
@@ -45,27 +82,34 @@ func main() {
 
 	flag.Parse()
 
+	flagsSet := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		flagsSet[f.Name] = true
+	})
+
 	// list of directores with source to index
-	var indexDir []string
-	if len(flag.Args()) > 0 {
-		indexDir = flag.Args()
-		for _, path := range indexDir {
-			fi, err := os.Stat(path)
-			if err != nil {
-				log.Println("unable to access ", path, err)
-				return
-			}
-			if !fi.IsDir() {
-				log.Println("only dir inputs allowed")
-				return
-			}
+	flagCfg.IndexDirs = flag.Args()
+
+	cfg, err := loadConfig(cfgFile, flagCfg, flagsSet)
+	if err != nil {
+		log.Println("unable to read configuration", err)
+		return
+	}
+
+	for _, path := range cfg.IndexDirs {
+		fi, err := os.Stat(path)
+		if err != nil {
+			log.Println("unable to access ", path, err)
+			return
+		}
+		if !fi.IsDir() {
+			log.Println("only dir inputs allowed")
+			return
 		}
-	} else {
-		indexDir = []string{"."}
 	}
 
 	if dbFilePrint != "" {
-		db := newSymbolsDB(dbDir)
+		db := newSymbolsDB(cfg.DB, 0)
 		err := db.PrintAndCheckSymbolsTUDB(dbFilePrint)
 		if err != nil {
 			log.Println(err)
@@ -80,11 +124,11 @@ func main() {
 
 	// if we need to reset the database, erase the old one
 	if resetDB {
-		os.RemoveAll(dbDir)
+		os.RemoveAll(cfg.DB)
 	}
 
 	// start files handler
-	err := startFilesHandler(indexDir, nIndexingThreads, dbDir)
+	err = startFilesHandler(cfg)
 	if err != nil {
 		log.Println("unable to start daemon", err)
 		return
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Consistency checker over the global index. Symbols with external linkage
+ * share their USR across TUs, e.g. every "struct config" or every non-static
+ * "init" function, so the index merges them. The checker reports when they are
+ * not the same thing:
+ *
+ * - multiple definitions: a function or global variable defined in several
+ *   places, e.g. in files linked in different binaries.
+ * - declaration mismatch: a declaration of a function or global variable
+ *   whose type differs from the one of its definition.
+ * - conflicting layouts: a struct, union or typedef defined with different
+ *   fields or types.
+ *
+ * Types are compared by their canonical spelling, and struct layouts by their
+ * fields and size (see declType).
+ *
+ *   $ navc odr-check -format json
+ */
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// OdrLoc is a declaration or definition involved in a conflict.
+type OdrLoc struct {
+	File string
+	Line int
+	Col  int
+	Type string
+}
+
+// OdrConflict is a symbol declared or defined incompatibly.
+type OdrConflict struct {
+	Problem string
+	Name    string
+	Kind    string
+	Locs    []OdrLoc
+}
+
+func (gi *globalIndex) odrLocs(sym *globalSymbol, locs []symbolLoc) []OdrLoc {
+	odrLocs := []OdrLoc{}
+	for _, loc := range locs {
+		odrLocs = append(odrLocs, OdrLoc{
+			File: gi.path(loc.File),
+			Line: int(loc.Line),
+			Col:  int(loc.Col),
+			Type: sym.Types[loc],
+		})
+	}
+	sort.Slice(odrLocs, func(i, j int) bool {
+		if odrLocs[i].File != odrLocs[j].File {
+			return odrLocs[i].File < odrLocs[j].File
+		}
+		return odrLocs[i].Line < odrLocs[j].Line
+	})
+
+	return odrLocs
+}
+
+func (gi *globalIndex) checkSymbol(sym *globalSymbol) []OdrConflict {
+	conflicts := []OdrConflict{}
+	add := func(problem string, locs []symbolLoc) {
+		conflicts = append(conflicts, OdrConflict{
+			Problem: problem,
+			Name:    sym.Name,
+			Kind:    sym.Kind,
+			Locs:    gi.odrLocs(sym, locs),
+		})
+	}
+
+	switch sym.Kind {
+	case "function", "variable":
+		if len(sym.Defs) > 1 {
+			add("multiple definitions", sym.Defs)
+		}
+
+		isDef := make(map[symbolLoc]bool)
+		for _, def := range sym.Defs {
+			isDef[def] = true
+		}
+		for _, def := range sym.Defs {
+			defType := sym.Types[def]
+			if defType == "" {
+				continue
+			}
+			mismatch := []symbolLoc{}
+			for _, decl := range sym.Decls {
+				typ := sym.Types[decl]
+				if !isDef[decl] && typ != "" && typ != defType {
+					mismatch = append(mismatch, decl)
+				}
+			}
+			if len(mismatch) > 0 {
+				add("declaration mismatch", append([]symbolLoc{def}, mismatch...))
+			}
+		}
+	case "struct", "union", "typedef":
+		// one location of every different layout
+		byType := make(map[string]symbolLoc)
+		for loc, typ := range sym.Types {
+			if first, seen := byType[typ]; !seen ||
+				gi.path(loc.File) < gi.path(first.File) {
+				byType[typ] = loc
+			}
+		}
+		if len(byType) > 1 {
+			locs := []symbolLoc{}
+			for _, loc := range byType {
+				locs = append(locs, loc)
+			}
+			add("conflicting layouts", locs)
+		}
+	}
+
+	return conflicts
+}
+
+// odrCheck returns the conflicts of all the symbols, sorted by location.
+func odrCheck(gi *globalIndex) []OdrConflict {
+	conflicts := []OdrConflict{}
+	for _, sym := range gi.symbols {
+		conflicts = append(conflicts, gi.checkSymbol(sym)...)
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		a, b := conflicts[i].Locs[0], conflicts[j].Locs[0]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return conflicts[i].Problem < conflicts[j].Problem
+	})
+
+	return conflicts
+}
+
+func writeOdrConflicts(w io.Writer, conflicts []OdrConflict, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(conflicts)
+	case "text":
+		for _, conflict := range conflicts {
+			first := conflict.Locs[0]
+			fmt.Fprintf(w, "%s:%d:%d: %s of %s %s\n", first.File,
+				first.Line, first.Col, conflict.Problem, conflict.Kind,
+				conflict.Name)
+			for _, loc := range conflict.Locs {
+				fmt.Fprintf(w, "\t%s:%d:%d: %s\n", loc.File, loc.Line,
+					loc.Col, loc.Type)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown report format %q", format)
+}
+
+// odrCheckCmd runs the odr-check command.
+func odrCheckCmd(args []string) error {
+	fs := flag.NewFlagSet("odr-check", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	format := fs.String("format", "text", "Output format: text or json")
+	fs.Parse(args)
+
+	gi, err := openGlobalIndex(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	return writeOdrConflicts(os.Stdout, odrCheck(gi), *format)
+}
@@ -18,16 +18,44 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-clang/v3.6/clang"
 )
 
 type parse struct {
+	cdb *compileDB
+	ext *externalIndex
+
+	// content hash of the headers, indexed by path, to not hash the same
+	// header for every translation unit
+	hashes map[string]hashEntry
+}
+
+type hashEntry struct {
+	mtime time.Time
+	size  int64
+	hash  fileHash
+}
+
+type compileDB struct {
+	sync.RWMutex
+	inputDirs []string
+
 	cas map[string][]string
+
+	// files in cas indexed by directory, used to infer arguments
+	casDirs map[string][]string
+
+	// flag files read, indexed by directory (see compile-flags.go)
+	flagDirs map[string]*dirFlags
 }
 
 /*
@@ -35,7 +63,7 @@ type parse struct {
  * aguments database that I think this deserves a long explanation. Compilation
  * database (compile_command.json) provides absolute path of the file with its
  * compilation options. We are storing this compilation options/arguments in
- * the cas field of the Parser struct to be used during parsing. This is a map
+ * the cas field of the compileDB struct to be used during parsing. This is a map
  * of file name to list of arguments. The name file should match the one
  * returned by the directory traversing in main, i.e., the minimum relative
  * path of the file (the path returned by filepath.Clean) or the absolute path
@@ -44,18 +72,36 @@ type parse struct {
  * file path read, we fix the full path to match the relative or absolute path
  * of the input (fixPaths) and clean it with filepath.Clean.
  *
- * Then, we need to make sure that the directories in the -I options also match
- * the relative or absolute path from the input. This is fixed in fixCompDirArg
- * right before populating the arguments for some specific file.
+ * Then, we need to make sure that the directories in the -I options (and the
+ * paths of -iquote, -isystem, -idirafter and -include) also match the relative
+ * or absolute path from the input. This is fixed in fixCompDirArg right before
+ * populating the arguments for some specific file. Besides these, only the -D
+ * and -std= options are kept.
+ *
+ * Files not in the compilation database (new files, headers parsed on their
+ * own, etc.) would be parsed without any -I or -D. Instead, we borrow the
+ * arguments of the most similar file in the database (inferArgsFrom): a file in
+ * the same directory, preferring the longest common name prefix, or else the
+ * file with the closest directory. The source of the arguments is kept in the
+ * TUDB (FlagsSource) to be reported.
  */
 
 type compArgs struct {
 	Directory string
 	Command   string
+	Arguments []string
 	File      string
 }
 
 func fixPaths(cas []compArgs, path string) {
+	// files may be relative to the compilation directory
+	for i := range cas {
+		ca := &cas[i]
+		if !filepath.IsAbs(ca.File) {
+			ca.File = filepath.Join(ca.Directory, ca.File)
+		}
+	}
+
 	// first, find absolute path of @path
 	if filepath.IsAbs(path) {
 		return
@@ -106,60 +152,273 @@ func fixCompDirArg(argDir, path string) string {
 	return filepath.Clean(path + "/" + argDir)
 }
 
+// options whose value is a path, fixed as the -I directories
+var compPathOpts = []string{"-I", "-iquote", "-isystem", "-idirafter", "-include"}
+
+// compPathOpt returns the path option of arg, or an empty string.
+func compPathOpt(arg string) string {
+	for _, opt := range compPathOpts {
+		if strings.HasPrefix(arg, opt) {
+			return opt
+		}
+	}
+
+	return ""
+}
+
 func getCompArgs(command, path string) []string {
 	args := []string{}
 
 	argsList := strings.Fields(command)
 
 	for i, arg := range argsList {
+		opt := compPathOpt(arg)
 		switch {
+		case (arg == "-D" || arg == opt) && i+1 == len(argsList):
+			// missing value, e.g. a truncated flags file
+			log.Println("ignoring", arg, "without value in", path)
 		case arg == "-D":
 			args = append(args, arg, argsList[i+1])
-		case strings.HasPrefix(arg, "-D"):
+		case strings.HasPrefix(arg, "-D"), strings.HasPrefix(arg, "-std="):
 			args = append(args, arg)
-		case arg == "-I":
-			argDir := fixCompDirArg(argsList[i+1], path)
-			args = append(args, "-I", argDir)
-		case strings.HasPrefix(arg, "-I"):
-			argDir := fixCompDirArg(
-				strings.Replace(arg, "-I", "", 1),
-				path)
-			args = append(args, "-I", argDir)
+		case opt == "":
+			// other options are dropped
+		case arg == opt:
+			argPath := fixCompDirArg(argsList[i+1], path)
+			args = append(args, opt, argPath)
+		default:
+			argPath := fixCompDirArg(strings.TrimPrefix(arg, opt), path)
+			args = append(args, opt, argPath)
 		}
 	}
 
 	return args
 }
 
-func newParser(inputDirs []string) *parse {
-	ret := &parse{make(map[string][]string)}
+// includeSearchPaths returns the directories where the headers included by
+// file are looked for, in the order of the preprocessor: the directory of file
+// (for quoted includes), the ones in the arguments and the system ones.
+func includeSearchPaths(file string, args []string) []string {
+	paths := []string{filepath.Dir(file)}
+	for i := 0; i < len(args); i++ {
+		for _, opt := range []string{"-iquote", "-I", "-isystem", "-idirafter"} {
+			if !strings.HasPrefix(args[i], opt) {
+				continue
+			}
+			dir := strings.TrimPrefix(args[i], opt)
+			if dir == "" && i+1 < len(args) {
+				i++
+				dir = args[i]
+			}
+			paths = append(paths, filepath.Clean(dir))
+			break
+		}
+	}
+
+	return append(paths, cfg.SysInclDirs...)
+}
+
+func newParser(cdb *compileDB, ext *externalIndex) *parse {
+	return &parse{
+		cdb:    cdb,
+		ext:    ext,
+		hashes: make(map[string]hashEntry),
+	}
+}
+
+func commonPrefixLen(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func pathComponents(path string) []string {
+	if path == "." {
+		return []string{}
+	}
+	return strings.Split(filepath.ToSlash(path), "/")
+}
+
+func readCompArgs(path string) (map[string][]string, error) {
+	f, err := os.Open(path + "/compile_commands.json")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	var cas []compArgs
+	err = dec.Decode(&cas)
+	if err != nil {
+		return nil, err
+	}
+
+	fixPaths(cas, path)
+
+	// index compArgs by file names
+	ret := make(map[string][]string)
+	for _, ca := range cas {
+		command := ca.Command
+		if command == "" {
+			command = strings.Join(ca.Arguments, " ")
+		}
+		ret[ca.File] = getCompArgs(command, path)
+	}
+
+	return ret, nil
+}
+
+// newCompileDB reads the compilation databases of the input directories. The
+// result is shared by all the parsers.
+func newCompileDB(inputDirs []string) *compileDB {
+	cdb := &compileDB{
+		inputDirs: inputDirs,
+		flagDirs:  make(map[string]*dirFlags),
+	}
+
+	err := cdb.Reload()
+	if err != nil {
+		log.Panic("error opening compile db: ", err)
+	}
+
+	return cdb
+}
+
+// Reload reads again the compilation databases. On error, the old ones are
+// kept.
+func (cdb *compileDB) Reload() error {
+	cas := make(map[string][]string)
 
 	// read compilation args db and fix files paths
-	for _, path := range inputDirs {
-		f, err := os.Open(path + "/compile_commands.json")
-		if os.IsPermission(err) {
-			log.Panic("error opening compile db: ", err)
-		} else if err != nil {
+	for _, path := range cdb.inputDirs {
+		pathCas, err := readCompArgs(path)
+		if os.IsNotExist(err) {
 			continue
+		} else if err != nil {
+			return err
 		}
-		defer f.Close()
 
-		dec := json.NewDecoder(f)
-		var cas []compArgs
-		err = dec.Decode(&cas)
-		if err != nil {
-			log.Panic(err)
+		for file, args := range pathCas {
+			cas[file] = args
 		}
+	}
+
+	casDirs := make(map[string][]string)
+	for file := range cas {
+		dir := filepath.Dir(file)
+		casDirs[dir] = append(casDirs[dir], file)
+	}
+	for _, files := range casDirs {
+		sort.Strings(files)
+	}
+
+	cdb.Lock()
+	defer cdb.Unlock()
 
-		fixPaths(cas, path)
+	cdb.cas = cas
+	cdb.casDirs = casDirs
+
+	return nil
+}
+
+// Has checks if file is in the compilation databases.
+func (cdb *compileDB) Has(file string) bool {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	_, ok := cdb.cas[file]
+	return ok
+}
 
-		// index compArgs by file names
-		for _, ca := range cas {
-			ret.cas[ca.File] = getCompArgs(ca.Command, path)
+// HasDir checks if there is any file of dir in the compilation databases.
+func (cdb *compileDB) HasDir(dir string) bool {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	return len(cdb.casDirs[dir]) > 0
+}
+
+// Files returns all the files in the compilation databases.
+func (cdb *compileDB) Files() []string {
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	files := []string{}
+	for file := range cdb.cas {
+		files = append(files, file)
+	}
+
+	return files
+}
+
+// inferArgsFrom returns the file in the compilation database whose arguments
+// are the best guess for file, or an empty string if there is none. It must be
+// called with the lock held.
+func (cdb *compileDB) inferArgsFrom(file string) string {
+	dir := filepath.Dir(file)
+	base := filepath.Base(file)
+
+	// a sibling with the longest common name prefix
+	best, bestLen := "", -1
+	for _, sibling := range cdb.casDirs[dir] {
+		n := commonPrefixLen(base, filepath.Base(sibling))
+		if n > bestLen {
+			best, bestLen = sibling, n
+		}
+	}
+	if best != "" {
+		return best
+	}
+
+	// the closest directory: most common components, then fewest extra
+	dirComps := pathComponents(dir)
+	bestDir, bestCommon, bestExtra := "", -1, 0
+	for casDir := range cdb.casDirs {
+		comps := pathComponents(casDir)
+		common := 0
+		for common < len(comps) && common < len(dirComps) &&
+			comps[common] == dirComps[common] {
+			common++
+		}
+		extra := len(comps) - common
+		if common > bestCommon ||
+			(common == bestCommon && extra < bestExtra) ||
+			(common == bestCommon && extra == bestExtra && casDir < bestDir) {
+			bestDir, bestCommon, bestExtra = casDir, common, extra
 		}
 	}
+	if bestDir == "" {
+		return ""
+	}
 
-	return ret
+	return cdb.casDirs[bestDir][0]
+}
+
+// Args returns the compilation arguments of file and where they come from. In
+// order of precedence: compile_commands.json, the flag files, and the
+// arguments of a similar file in compile_commands.json.
+func (cdb *compileDB) Args(file string) ([]string, string) {
+	cdb.RLock()
+	args, ok := cdb.cas[file]
+	cdb.RUnlock()
+	if ok {
+		return args, "compile_commands.json"
+	}
+
+	if args, source := cdb.flagFilesArgs(file); source != "" {
+		return args, source
+	}
+
+	cdb.RLock()
+	defer cdb.RUnlock()
+
+	if from := cdb.inferArgsFrom(file); from != "" {
+		return cdb.cas[from], "inferred from " + from
+	}
+
+	return []string{}, "none"
 }
 
 func getSymbolFromCursor(cursor *clang.Cursor) *symbolInfo {
@@ -173,27 +432,279 @@ func getSymbolFromCursor(cursor *clang.Cursor) *symbolInfo {
 		name: cursor.Spelling(),
 		usr:  cursor.USR(),
 		loc: SymbolLocReq{
-			fName,
-			int(line),
-			int(col),
+			File: fName,
+			Line: int(line),
+			Col:  int(col),
 		},
 	}
 }
 
+// declKind returns the kind of a declaration cursor, named as in ctags.
+func declKind(cursor *clang.Cursor) string {
+	switch cursor.Kind() {
+	case clang.Cursor_FunctionDecl:
+		return "function"
+	case clang.Cursor_StructDecl:
+		return "struct"
+	case clang.Cursor_UnionDecl:
+		return "union"
+	case clang.Cursor_EnumDecl:
+		return "enum"
+	case clang.Cursor_EnumConstantDecl:
+		return "enumerator"
+	case clang.Cursor_FieldDecl:
+		return "member"
+	case clang.Cursor_TypedefDecl:
+		return "typedef"
+	case clang.Cursor_MacroDefinition:
+		return "macro"
+	case clang.Cursor_ParmDecl:
+		return "parameter"
+	case clang.Cursor_VarDecl:
+		if cursor.SemanticParent().Kind() == clang.Cursor_FunctionDecl {
+			return "local"
+		}
+		return "variable"
+	}
+
+	return ""
+}
+
+// declType returns the canonical type of a function, global variable or
+// typedef, or the layout (fields and size) of a struct or union definition.
+// It is used to find conflicting declarations across TUs (see odr.go).
+func declType(cursor *clang.Cursor, kind string) string {
+	switch kind {
+	case "function", "variable":
+		return cursor.Type().CanonicalType().Spelling()
+	case "typedef":
+		return cursor.TypedefDeclUnderlyingType().CanonicalType().Spelling()
+	case "struct", "union":
+		if !cursor.IsCursorDefinition() {
+			return ""
+		}
+		fields := []string{}
+		cursor.Visit(func(child, parent clang.Cursor) clang.ChildVisitResult {
+			if child.Kind() == clang.Cursor_FieldDecl {
+				fields = append(fields, child.Type().CanonicalType().Spelling()+
+					" "+child.Spelling())
+			}
+			return clang.ChildVisit_Continue
+		})
+		return fmt.Sprintf("{%s} size %d", strings.Join(fields, "; "),
+			cursor.Type().SizeOf())
+	}
+
+	return ""
+}
+
+// setDeclTypeRef fills the type of a variable, field or parameter, the result
+// type of a function or the underlying type of a typedef, and the declaration
+// of its base type, i.e. without pointers and arrays (see types.go).
+func setDeclTypeRef(cursor *clang.Cursor, sym *symbolInfo) {
+	var typ clang.Type
+	switch sym.kind {
+	case "variable", "local", "parameter", "member":
+		typ = cursor.Type()
+	case "function":
+		typ = cursor.ResultType()
+	case "typedef":
+		typ = cursor.TypedefDeclUnderlyingType()
+	default:
+		return
+	}
+	sym.typeName = typ.Spelling()
+	sym.typeCanonical = typ.CanonicalType().Spelling()
+
+	for {
+		switch typ.Kind() {
+		case clang.Type_Pointer:
+			typ = typ.PointeeType()
+			continue
+		case clang.Type_ConstantArray, clang.Type_IncompleteArray:
+			typ = typ.ArrayElementType()
+			continue
+		}
+		break
+	}
+
+	decl := typ.Declaration()
+	switch decl.Kind() {
+	case clang.Cursor_TypedefDecl, clang.Cursor_StructDecl, clang.Cursor_UnionDecl,
+		clang.Cursor_EnumDecl:
+		sym.typeUSR = decl.USR()
+	}
+}
+
+// setDeclInfo fills the kind, type, linkage and scope of a declaration.
+func setDeclInfo(cursor *clang.Cursor, sym *symbolInfo) {
+	sym.kind = declKind(cursor)
+	sym.typ = declType(cursor, sym.kind)
+	setDeclTypeRef(cursor, sym)
+	sym.static = cursor.Linkage() == clang.Linkage_Internal
+
+	parent := cursor.SemanticParent()
+	switch parent.Kind() {
+	case clang.Cursor_StructDecl, clang.Cursor_UnionDecl, clang.Cursor_EnumDecl,
+		clang.Cursor_FunctionDecl:
+		if parent.Spelling() != "" {
+			sym.scope = declKind(&parent) + ":" + parent.Spelling()
+		}
+	}
+}
+
+// parenExpr is a parenthesized expression and its parent.
+type parenExpr struct {
+	paren  clang.Cursor
+	parent clang.Cursor
+}
+
+// parenExprs records the parents of the parenthesized expressions of a TU, by
+// cursor hash, as the visitor only gives the parent of the visited cursor.
+type parenExprs map[uint32][]parenExpr
+
+func (pe parenExprs) add(paren, parent clang.Cursor) {
+	hash := paren.HashCursor()
+	pe[hash] = append(pe[hash], parenExpr{paren, parent})
+}
+
+// skip returns the operand and the expression accessing it, skipping the
+// parentheses around cursor, e.g. for (x) = 1 the operand is (x).
+func (pe parenExprs) skip(cursor, parent clang.Cursor) (clang.Cursor, clang.Cursor) {
+	for parent.Kind() == clang.Cursor_ParenExpr {
+		found := false
+		for _, expr := range pe[parent.HashCursor()] {
+			if expr.paren.Equal(parent) {
+				cursor, parent = expr.paren, expr.parent
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	return cursor, parent
+}
+
+// getUseAccess returns how the variable or field referenced by cursor is
+// accessed by its parent expression: written by the left side of =, read and
+// written by compound assignments, ++ and --, or address taken by &. The
+// operator of binary and unary expressions is not in the libclang API, so it is
+// the token after the left side, or the last token before the operand.
+func getUseAccess(cursor, parent *clang.Cursor) useAccess {
+	_, _, _, start := cursor.Extent().Start().FileLocation()
+	_, _, _, end := cursor.Extent().End().FileLocation()
+	_, _, _, parentStart := parent.Extent().Start().FileLocation()
+	lhs := start == parentStart
+
+	switch parent.Kind() {
+	case clang.Cursor_CompoundAssignOperator:
+		if lhs {
+			return accessReadWrite
+		}
+		return accessRead
+	case clang.Cursor_BinaryOperator, clang.Cursor_UnaryOperator:
+	default:
+		return accessRead
+	}
+
+	tu := cursor.TranslationUnit()
+	op := ""
+	for _, tok := range tu.Tokenize(parent.Extent()) {
+		_, _, _, offset := tu.TokenLocation(tok).FileLocation()
+		if lhs && offset >= end {
+			op = tu.TokenSpelling(tok)
+			break
+		}
+		if !lhs {
+			if offset >= start {
+				break
+			}
+			op = tu.TokenSpelling(tok)
+		}
+	}
+
+	switch {
+	case parent.Kind() == clang.Cursor_BinaryOperator:
+		if lhs && op == "=" {
+			return accessWrite
+		}
+	case op == "++" || op == "--":
+		return accessReadWrite
+	case op == "&" && !lhs:
+		return accessAddr
+	}
+
+	return accessRead
+}
+
+// getFileStamp returns the modification time and the content hash of a file.
+// The time is the one of os.Stat, as clang's has only a resolution of seconds.
+func (pa *parse) getFileStamp(file clang.File) headerStamp {
+	path := filepath.Clean(file.Name())
+	info, err := os.Stat(path)
+	if err != nil {
+		// leave a zero stamp, it will look changed next time
+		log.Println("unable to stat", path, err)
+		return headerStamp{}
+	}
+
+	entry, ok := pa.hashes[path]
+	if ok && entry.mtime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return headerStamp{entry.mtime, entry.hash}
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		log.Println("unable to hash", path, err)
+		return headerStamp{}
+	}
+	pa.hashes[path] = hashEntry{info.ModTime(), info.Size(), hash}
+
+	return headerStamp{info.ModTime(), hash}
+}
+
+// externalTUDB returns the TUDB where to insert the symbols of the external
+// header file, or nil if the header is already in the external cache. exts has the TUDBs of the external headers of this parse.
+func (pa *parse) externalTUDB(file clang.File, exts map[string]*symbolsTUDB) *symbolsTUDB {
+	path := filepath.Clean(file.Name())
+	etudb, exist := exts[path]
+	if exist {
+		return etudb
+	}
+
+	stamp := pa.getFileStamp(file)
+	if !pa.ext.Fresh(path, stamp.Hash) {
+		etudb = newSymbolsTUDB(path, stamp.Mtime)
+		etudb.Hash = stamp.Hash
+	}
+	exts[path] = etudb
+
+	return etudb
+}
+
 func (pa *parse) Parse(file string) *symbolsTUDB {
 	idx := clang.NewIndex(0, 0)
 	defer idx.Dispose()
 
-	args, ok := pa.cas[file]
-	if !ok {
-		args = []string{}
-	}
+	args, flagsSource := pa.cdb.Args(file)
+	log.Println("parsing", file, "flags:", flagsSource)
 	tu := idx.ParseTranslationUnit(file, args, nil, clang.TranslationUnit_DetailedPreprocessingRecord)
 	defer tu.Dispose()
 
-	db := newSymbolsTUDB(file, tu.File(file).Time())
+	stamp := pa.getFileStamp(tu.File(file))
+	db := newSymbolsTUDB(file, stamp.Mtime)
+	db.Hash = stamp.Hash
+	db.FlagsSource = flagsSource
+	db.SearchPaths = includeSearchPaths(file, args)
+	db.Standalone = isHFile(file)
 	defer db.TempSaveDB()
 
+	exts := make(map[string]*symbolsTUDB)
+	parens := make(parenExprs)
+
 	visitNode := func(cursor, parent clang.Cursor) clang.ChildVisitResult {
 		if cursor.IsNull() {
 			return clang.ChildVisit_Continue
@@ -207,6 +718,18 @@ func (pa *parse) Parse(file string) *symbolsTUDB {
 			return clang.ChildVisit_Continue
 		}
 
+		// symbols in external headers go to the external cache, if
+		// enabled, but their inclusions are dependencies of the TU
+		tdb := db
+		if pa.ext.Enabled() && pa.ext.IsExternal(curFile) &&
+			cursor.Kind() != clang.Cursor_InclusionDirective {
+			f, _, _, _ := cursor.Location().FileLocation()
+			tdb = pa.externalTUDB(f, exts)
+			if tdb == nil {
+				return clang.ChildVisit_Continue
+			}
+		}
+
 		// TODO: erase! this is not required
 		if false {
 			log.Printf("%s: %s (%s)\n",
@@ -218,34 +741,75 @@ func (pa *parse) Parse(file string) *symbolsTUDB {
 		////////////////////////////////////
 		switch cursor.Kind() {
 		case clang.Cursor_FunctionDecl, clang.Cursor_StructDecl, clang.Cursor_FieldDecl,
-			clang.Cursor_TypedefDecl, clang.Cursor_EnumDecl, clang.Cursor_EnumConstantDecl:
+			clang.Cursor_TypedefDecl, clang.Cursor_EnumDecl, clang.Cursor_EnumConstantDecl,
+			clang.Cursor_UnionDecl:
+			setDeclInfo(&cursor, cur)
+			if cursor.Kind() == clang.Cursor_FunctionDecl &&
+				cursor.IsCursorDefinition() {
+				_, endLine, _, _ := cursor.Extent().End().FileLocation()
+				tdb.InsertFuncRange(cur, int(endLine))
+			}
 			defCursor := cursor.Definition()
 			if !defCursor.IsNull() {
 				def := getSymbolFromCursor(&defCursor)
-				db.InsertSymbolDeclWithDef(cur, def)
+				tdb.InsertSymbolDeclWithDef(cur, def)
 			} else {
-				db.InsertSymbolDecl(cur)
+				tdb.InsertSymbolDecl(cur)
 			}
 		case clang.Cursor_MacroDefinition:
-			db.InsertSymbolDeclWithDef(cur, cur)
+			setDeclInfo(&cursor, cur)
+			tdb.InsertSymbolDeclWithDef(cur, cur)
 		case clang.Cursor_VarDecl:
-			db.InsertSymbolDecl(cur)
+			setDeclInfo(&cursor, cur)
+			insertVarFuncStore(tdb, &cursor)
+			tdb.InsertSymbolDecl(cur)
+			if cur.kind == "variable" && cursor.IsCursorDefinition() {
+				tdb.InsertVarDef(cur)
+			}
 		case clang.Cursor_ParmDecl:
 			if cursor.Spelling() != "" {
-				db.InsertSymbolDecl(cur)
+				setDeclInfo(&cursor, cur)
+				tdb.InsertSymbolDecl(cur)
 			}
 		case clang.Cursor_CallExpr:
 			decCursor := cursor.Referenced()
 			dec := getSymbolFromCursor(&decCursor)
-			db.InsertSymbolUse(cur, dec, true)
-		case clang.Cursor_DeclRefExpr, clang.Cursor_TypeRef, clang.Cursor_MemberRefExpr,
-			clang.Cursor_MacroExpansion:
+			tdb.InsertSymbolUse(cur, dec, true, accessRead)
+		case clang.Cursor_DeclRefExpr, clang.Cursor_MemberRefExpr:
+			decCursor := cursor.Referenced()
+			dec := getSymbolFromCursor(&decCursor)
+			access := accessAddr
+			if decCursor.Kind() != clang.Cursor_FunctionDecl {
+				operand, expr := parens.skip(cursor, parent)
+				access = getUseAccess(&operand, &expr)
+			}
+			tdb.InsertSymbolUse(cur, dec, false, access)
+		case clang.Cursor_ParenExpr:
+			parens.add(cursor, parent)
+		case clang.Cursor_BinaryOperator:
+			insertAssignFuncStore(tdb, &cursor)
+		case clang.Cursor_InitListExpr:
+			insertInitListFuncStores(tdb, &cursor, &parent)
+		case clang.Cursor_MemberRef:
+			// field designator of an initializer, .field = value
+			decCursor := cursor.Referenced()
+			dec := getSymbolFromCursor(&decCursor)
+			tdb.InsertSymbolUse(cur, dec, false, accessWrite)
+		case clang.Cursor_TypeRef, clang.Cursor_MacroExpansion:
 			decCursor := cursor.Referenced()
 			dec := getSymbolFromCursor(&decCursor)
-			db.InsertSymbolUse(cur, dec, false)
+			tdb.InsertSymbolUse(cur, dec, false, accessRead)
 		case clang.Cursor_InclusionDirective:
 			incFile := cursor.IncludedFile()
-			db.InsertHeader(cursor.Spelling(), incFile)
+			var incStamp headerStamp
+			if incFile.Name() != "" {
+				incStamp = pa.getFileStamp(incFile)
+			} else {
+				log.Printf("%s:%d: %s not found in %s\n", curFile,
+					cur.loc.Line, cursor.Spelling(),
+					strings.Join(db.SearchPaths, ", "))
+			}
+			db.InsertHeader(cur, incFile, incStamp)
 		}
 
 		return clang.ChildVisit_Recurse
@@ -253,5 +817,15 @@ func (pa *parse) Parse(file string) *symbolsTUDB {
 
 	tu.TranslationUnitCursor().Visit(visitNode)
 
+	for _, etudb := range exts {
+		if etudb == nil {
+			continue
+		}
+		err := pa.ext.Store(etudb)
+		if err != nil {
+			log.Println("unable to store external header", etudb.File, err)
+		}
+	}
+
 	return db
 }
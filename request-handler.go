@@ -32,8 +32,9 @@ type RequestHandler struct {
 }
 
 // GetSymbolDecls gets a symbol use location and returns the list of
-// declarations for that symbol.
-func (rh *RequestHandler) GetSymbolDecls(use *SymbolLocReq, res *[]*SymbolLocReq) error {
+// declarations for that symbol. For locations in header files, the optional
+// context translation unit is used to look up the symbol.
+func (rh *RequestHandler) GetSymbolDecls(use *SymbolQuery, res *[]*SymbolLocReq) error {
 	dec, err := rh.db.GetSymbolDecl(use)
 	if err != nil {
 		return err
@@ -44,7 +45,7 @@ func (rh *RequestHandler) GetSymbolDecls(use *SymbolLocReq, res *[]*SymbolLocReq
 
 // GetSymbolUses gets a symbol use location and returns all the uses of that
 // symbol.
-func (rh *RequestHandler) GetSymbolUses(use *SymbolLocReq, res *[]*SymbolLocReq) error {
+func (rh *RequestHandler) GetSymbolUses(use *SymbolQuery, res *[]*SymbolLocReq) error {
 	uses, err := rh.db.GetSymbolUses(use)
 	if err != nil {
 		return err
@@ -55,14 +56,14 @@ func (rh *RequestHandler) GetSymbolUses(use *SymbolLocReq, res *[]*SymbolLocReq)
 
 // GetSymbolDef gets a symbol use location and returns the definition location
 // of the symbol. If not available, it returns an error.
-func (rh *RequestHandler) GetSymbolDef(use *SymbolLocReq, res *[]*SymbolLocReq) error {
+func (rh *RequestHandler) GetSymbolDef(use *SymbolQuery, res *[]*SymbolLocReq) error {
 	def, err := rh.db.GetSymbolDef(use)
 	if err != nil {
 		return err
 	}
 	if def == nil {
 		// find all definitions with the same name
-		defs, err := rh.db.GetAllSymbolDefs(use)
+		defs, err := rh.db.GetAllSymbolDefs(&use.SymbolLocReq)
 		if err != nil {
 			return err
 		}
@@ -73,6 +74,99 @@ func (rh *RequestHandler) GetSymbolDef(use *SymbolLocReq, res *[]*SymbolLocReq)
 	return nil
 }
 
+// GetTypeInfo gets a symbol use location and returns the declared and canonical
+// types of the symbol, with the chain of typedefs to its base type.
+func (rh *RequestHandler) GetTypeInfo(use *SymbolQuery, res *TypeInfo) error {
+	info, err := rh.db.GetTypeInfo(use)
+	if err != nil {
+		return err
+	}
+	*res = *info
+	return nil
+}
+
+// GetTypeDef gets a symbol use location and returns the definition of the
+// struct, union or enum type of the symbol, going through typedefs.
+func (rh *RequestHandler) GetTypeDef(use *SymbolQuery, res *[]*SymbolLocReq) error {
+	def, err := rh.db.GetTypeDef(use)
+	if err != nil {
+		return err
+	}
+	*res = []*SymbolLocReq{def}
+	return nil
+}
+
+// GetFileStatus gets a file name and returns its indexing status, including
+// where its compilation flags come from.
+func (rh *RequestHandler) GetFileStatus(file *string, res *FileStatus) error {
+	status, err := rh.db.GetFileStatus(*file)
+	if err != nil {
+		return err
+	}
+	*res = *status
+	return nil
+}
+
+// GetIncluders gets a header and returns the TUs including it, or the files
+// with an #include of it if Direct is set.
+func (rh *RequestHandler) GetIncluders(query *IncludeQuery, res *[]string) error {
+	includers, err := rh.db.IncludersOf(query)
+	if err != nil {
+		return err
+	}
+	*res = includers
+	return nil
+}
+
+// GetIncludees gets a file and returns the headers it includes, only the ones
+// with an #include in the file if Direct is set.
+func (rh *RequestHandler) GetIncludees(query *IncludeQuery, res *[]string) error {
+	includees, err := rh.db.IncludeesOf(query)
+	if err != nil {
+		return err
+	}
+	*res = includees
+	return nil
+}
+
+// GetIncludeChain gets a TU and a header, and returns the chain of #include
+// directives that includes the header in the TU.
+func (rh *RequestHandler) GetIncludeChain(query *IncludeChainQuery, res *[]IncludeStep) error {
+	chain, err := rh.db.IncludeChain(query)
+	if err != nil {
+		return err
+	}
+	*res = chain
+	return nil
+}
+
+// GetIncludeReport gets a file and returns its unused and missing includes.
+func (rh *RequestHandler) GetIncludeReport(query *IncludeQuery, res *IncludeReport) error {
+	report, err := rh.db.IncludeReportOf(query)
+	if err != nil {
+		return err
+	}
+	*res = *report
+	return nil
+}
+
+// GetDeadCode gets a file name and returns the symbols defined in it without
+// any use in the project.
+func (rh *RequestHandler) GetDeadCode(file *string, res *[]DeadSymbol) error {
+	dead, err := rh.db.GetDeadCode(*file)
+	if err != nil {
+		return err
+	}
+	*res = dead
+	return nil
+}
+
+// GetCacheStats returns the hit and miss statistics of the symbols DB cache.
+func (rh *RequestHandler) GetCacheStats(unused *int, res *CacheStats) error {
+	*res = rh.db.GetCacheStats()
+	return nil
+}
+
 func newRequestHandler(db *symbolsDB) *RequestHandler {
 	rh := &RequestHandler{db, rpc.NewServer()}
 
@@ -91,10 +185,7 @@ func (rh *RequestHandler) handleRequest(conn net.Conn) {
 	}
 }
 
-func listenRequests(newConn chan<- net.Conn) {
-	// socket file for communication with daemon
-	socketFile := ".navc.sock"
-
+func listenRequests(newConn chan<- net.Conn, socketFile string) {
 	// start serving requests
 	os.Remove(socketFile)
 	lis, err := net.Listen("unix", socketFile)
@@ -25,6 +25,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/go-clang/v3.6/clang"
@@ -47,9 +49,17 @@ import (
  *
  * - Mtime: Modification time of the file when was indexed.
  *
- * - Headers (fileID -> Time): Contains all the header files included in the
- * translation unit and the modification time of each when the translation unit
- * was indexed.
+ * - Hash: Hash of the content of the file when was indexed. Modification times
+ * are only used as a fast path. A file is considered changed only if its
+ * content hash differs, so touching a file (e.g. git checkout) or restoring an
+ * older backup does the right thing.
+ *
+ * - FlagsSource: Where the compilation arguments used to parse the file come
+ * from, e.g. compile_commands.json or inferred from a similar file.
+ *
+ * - Headers (fileID -> headerStamp): Contains all the header files included in
+ * the translation unit and the modification time and content hash of each when
+ * the translation unit was indexed.
  *
  * - SymLoc (symbolLoc -> symbolID): Contains all the symbols uses in the
  * translatio unit. It maps symbol locations to symbol ID.
@@ -59,7 +69,12 @@ import (
  * in the translation unit. The symbol data will have the list of declarations
  * of the symbol and the list of uses in the translation unit. If the definition
  * of the symbol is available in this translation unit, DefAvail will be true
- * and Def will hold the location of the definition.
+ * and Def will hold the location of the definition. Global variables have no
+ * Def, their definitions are only in VarDefs for the tags and reports.
+ *
+ * - Standalone: The translation unit is a header file parsed on its own,
+ * because no other translation unit includes it. Once a translation unit
+ * including the header is inserted, the standalone one is dropped.
  *
  * - Includers: In case the translation unit represent a header file, this list
  * will have all the translation units including this file. This is the only
@@ -79,10 +94,30 @@ import (
  * replace an old translation unit of a file. Translation units will be
  * persisted to disk whenever the symbolsDB is flushed. This is done by calling
  * the FlushDB function.
+ *
+ * The on disk format is versioned (dbVersion). If the DB directory was created
+ * by a different version, it is erased and the code indexed again, as well as
+ * the DBs created before the format was versioned (with an index file or a tmp
+ * directory, but no version file). Other directories without a version file
+ * are only used if empty.
+ *
+ * Loaded translation units are kept in memory until flushed. A single query on
+ * a popular header can load thousands of them, so the cache may have a memory
+ * budget (memBudget). Every loaded TUDB has an estimated size (estimateSize)
+ * and, whenever the sum goes over the budget, the least recently accessed
+ * TUDBs (accTime) are saved if dirty and released (evictTUDBs). The global
+ * index kept for dead code requests counts against the budget as well, and it
+ * is the first to be released. A budget of zero means no limit.
  */
 
 type symbolID [sha1.Size]byte
 type fileID [sha1.Size]byte
+type fileHash [sha1.Size]byte
+
+type headerStamp struct {
+	Mtime time.Time
+	Hash  fileHash
+}
 
 type symbolLoc struct {
 	File fileID
@@ -90,9 +125,53 @@ type symbolLoc struct {
 	Col  int16
 }
 
+// funcRange is the extent of a function definition, from the location of its
+// name to its last line.
+type funcRange struct {
+	ID    symbolID
+	Start symbolLoc
+	End   int16
+}
+
+// includeRef is an inclusion directive and the header it includes. Name is
+// the header as written in the directive.
+type includeRef struct {
+	Loc    symbolLoc
+	Header fileID
+	Name   string
+}
+
+// useAccess is how a use accesses the variable or field it references.
+type useAccess uint8
+
+const (
+	accessRead useAccess = iota
+	accessWrite
+	accessReadWrite
+	accessAddr
+)
+
+var accessNames = map[useAccess]string{
+	accessRead:      "read",
+	accessWrite:     "write",
+	accessReadWrite: "readwrite",
+	accessAddr:      "addr",
+}
+
 type symbolUse struct {
 	Loc      symbolLoc
 	FuncCall bool
+	Access   useAccess
+}
+
+// accessName returns the access of the use: read, write, readwrite, addr or
+// call.
+func (use *symbolUse) accessName() string {
+	if use.FuncCall {
+		return "call"
+	}
+
+	return accessNames[use.Access]
 }
 
 type symbolData struct {
@@ -101,29 +180,90 @@ type symbolData struct {
 	Decls    []symbolLoc
 	DefAvail bool
 	Def      symbolLoc
+
+	// declaration kind (see declKind), internal linkage and enclosing
+	// struct, union, enum or function, e.g. "struct:foo"
+	Kind   string
+	Static bool
+	Scope  string
+
+	// type of every declaration, if any (see declType)
+	DeclTypes map[symbolLoc]string
+
+	// declarations of a global variable that are definitions, tentative
+	// ones included
+	VarDefs []symbolLoc
+
+	// declared type of variables, fields, parameters, function results
+	// and typedefs, and the declaration of its base type (see types.go)
+	TypeName      string
+	TypeCanonical string
+	TypeAvail     bool
+	TypeDecl      symbolID
+}
+
+// FileStatus is the indexing status of a file returned by the daemon requests.
+type FileStatus struct {
+	File        string
+	Indexed     bool
+	Header      bool
+	Includers   int
+	FlagsSource string
 }
 
 // SymbolLocReq is used as input and output structure for the daemon requests.
+// External is set in the output for locations in system or third-party headers.
+// Access is set in the output of uses: read, write, readwrite, addr or call.
 type SymbolLocReq struct {
-	File string
-	Line int
-	Col  int
+	File     string
+	Line     int
+	Col      int
+	External bool   `json:",omitempty"`
+	Access   string `json:",omitempty"`
+}
+
+// SymbolQuery is the input of the symbol requests. Context is optional, and it
+// is the translation unit (e.g. the .c file the user came from) used to look up
+// locations in header files. AccessFilter optionally filters the uses by their
+// access, as a comma separated list, e.g. "write,readwrite".
+type SymbolQuery struct {
+	SymbolLocReq
+	Context      string
+	AccessFilter string `json:",omitempty"`
 }
 
 type symbolInfo struct {
 	name string
 	usr  string
 	loc  SymbolLocReq
+
+	// only for declarations
+	kind   string
+	typ    string
+	static bool
+	scope  string
+
+	// declared type, see setDeclTypeRef
+	typeName      string
+	typeCanonical string
+	typeUSR       string
 }
 
 type symbolsTUDB struct {
 	File string
 
 	// .c data
-	Mtime   time.Time
-	SymLoc  map[symbolLoc]symbolID
-	SymData map[symbolID]symbolData
-	Headers map[fileID]time.Time
+	Mtime       time.Time
+	Hash        fileHash
+	FlagsSource string
+	Standalone  bool
+	SymLoc      map[symbolLoc]symbolID
+	SymData     map[symbolID]symbolData
+	Headers     map[fileID]headerStamp
+	Funcs       []funcRange
+	Includes    []includeRef
+	FuncStores  []funcStore
+	SearchPaths []string
 
 	// .h lists
 	Includers map[fileID]bool
@@ -134,18 +274,69 @@ type symbolsTUDB struct {
 }
 
 type tuSymbolsDBCache struct {
-	tudb  *symbolsTUDB
-	Mtime time.Time
-	Path  string
+	tudb       *symbolsTUDB
+	Mtime      time.Time
+	Hash       fileHash
+	Path       string
+	Standalone bool
 
 	accTime time.Time
 	dirty   bool
+	size    int64
 }
 
 type symbolsDB struct {
 	TUDBs map[fileID]*tuSymbolsDBCache
+
+	// headers that lost their last includer
+	orphaned []string
+
+	// index of the system and third-party headers, and its TUDBs loaded
+	ext      *externalIndex
+	extTUDBs map[fileID]*tuSymbolsDBCache
+
+	// read-only indexes of dependencies (see bundle.go)
+	bundles []*bundle
+
+	// global index for the dead code requests, dropped on any change or if
+	// over the memory budget
+	global     *globalIndex
+	globalSize int64
+
+	// memory accounting of the loaded TUDBs
+	memBudget int64
+	memUsed   int64
+	stats     CacheStats
 }
 
+// CacheStats has the statistics of the in memory TUDB cache. It is exported
+// as it is returned by the daemon requests.
+type CacheStats struct {
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Loaded    int
+	MemUsed   int64
+	MemBudget int64
+}
+
+// approximated sizes in bytes of the TUDB structures (including map overhead)
+const (
+	tudbBaseSize     int64 = 512
+	symLocEntrySize  int64 = 64
+	symDataEntrySize int64 = 160
+	symUseSize       int64 = 28
+	symDeclSize      int64 = 24
+	fileEntrySize    int64 = 64
+)
+
+// percentage of the memory budget to evict down to
+const evictLowWater int64 = 90
+
+// version of the on disk format of the DB. Increase it on any change to the
+// serialized structures.
+const dbVersion string = "14"
+
 // db directory path
 var dbDirPath string
 
@@ -161,16 +352,78 @@ func getStringEncode(str string) [sha1.Size]byte {
 	return sha1.Sum([]byte(str))
 }
 
+// prefix of the names of the headers not found, added to not confuse them with
+// real files
+const nonExistingHeaderPrefix = "IDoNotReallyExist-"
+
 func nonExistingHeaderName(headPath string) string {
-	// adding magic to filename to not confuse it with real files
-	return "IDoNotReallyExist-" + filepath.Base(headPath)
+	return nonExistingHeaderPrefix + filepath.Base(headPath)
+}
+
+func hashFile(path string) (fileHash, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fileHash{}, err
+	}
+
+	return sha1.Sum(content), nil
+}
+
+// isLegacyDB returns whether the directory is a DB created before the format
+// was versioned, i.e. with an index file or a tmp directory.
+func isLegacyDB(dbDirPathIn string) bool {
+	for _, name := range []string{"/index", "/tmp"} {
+		if _, err := os.Stat(dbDirPathIn + name); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkDBVersion erases the DB directory if it was created with a different
+// on disk format. A directory that is not a DB, i.e. not empty and without a
+// version file, index or tmp directory (e.g. a mistyped -db), is never erased.
+func checkDBVersion(dbDirPathIn string) error {
+	version, err := ioutil.ReadFile(dbDirPathIn + "/version")
+	switch {
+	case err == nil && string(version) == dbVersion:
+		return nil
+	case err == nil:
+		log.Println("symbols DB format changed, reindexing")
+	case os.IsNotExist(err):
+		entries, err := ioutil.ReadDir(dbDirPathIn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(entries) > 0 && !isLegacyDB(dbDirPathIn) {
+			return fmt.Errorf("Directory %s is not a symbols DB, refusing to erase it",
+				dbDirPathIn)
+		}
+		if len(entries) > 0 {
+			log.Println("symbols DB without version, reindexing")
+		}
+	default:
+		return err
+	}
+
+	err = os.RemoveAll(dbDirPathIn)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(dbDirPathIn+"/tmp", 0700)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(dbDirPathIn+"/version", []byte(dbVersion), 0644)
 }
 
 ///// Symbols DB methods
 
-func newSymbolsDB(dbDirPathIn string) *symbolsDB {
-	// create index directory if it does not exist
-	err := os.MkdirAll(dbDirPathIn+"/tmp", 0700)
+func newSymbolsDB(dbDirPathIn string, memBudget int64) *symbolsDB {
+	// create index directory if it does not exist or it is outdated
+	err := checkDBVersion(dbDirPathIn)
 	if err != nil {
 		log.Panic("unable to create db dir ", err)
 	}
@@ -180,14 +433,33 @@ func newSymbolsDB(dbDirPathIn string) *symbolsDB {
 
 	newDB, err := loadSymbolsDBIndex()
 	if err != nil && os.IsNotExist(err) {
-		newDB = &symbolsDB{make(map[fileID]*tuSymbolsDBCache)}
+		newDB = &symbolsDB{TUDBs: make(map[fileID]*tuSymbolsDBCache)}
 	} else if err != nil {
 		return nil
 	}
+	newDB.memBudget = memBudget
 
 	return newDB
 }
 
+// openSymbolsDB opens an existing DB for reading, e.g. for the commands that
+// export it. Unlike newSymbolsDB, it never erases nor creates the DB.
+func openSymbolsDB(dbDirPathIn string) (*symbolsDB, error) {
+	version, err := ioutil.ReadFile(dbDirPathIn + "/version")
+	if err != nil {
+		return nil, err
+	}
+	if string(version) != dbVersion {
+		return nil, fmt.Errorf("DB %s has an old format, run the daemon to reindex it",
+			dbDirPathIn)
+	}
+	dbDirPath = dbDirPathIn
+	dbDirTmp = dbDirPath + "/tmp"
+	dbDirIndex = dbDirPath + "/index"
+
+	return loadSymbolsDBIndex()
+}
+
 func loadSymbolsDBIndex() (*symbolsDB, error) {
 	var index symbolsDB
 
@@ -235,14 +507,15 @@ func (db *symbolsDB) FlushDB(saveFrom time.Time) error {
 			continue
 		}
 
-		if cache.dirty {
-			err := cache.tudb.SaveSymbolsTUDB(getDBFileName(cache.Path))
-			if err != nil {
-				return err
-			}
+		err := db.releaseTUDB(cache)
+		if err != nil {
+			return err
+		}
+	}
+	for _, cache := range db.extTUDBs {
+		if cache.tudb != nil && !cache.accTime.After(saveFrom) {
+			db.forgetTUDB(cache)
 		}
-		cache.dirty = false
-		cache.tudb = nil
 	}
 
 	db.saveSymbolsDBIndex()
@@ -250,6 +523,160 @@ func (db *symbolsDB) FlushDB(saveFrom time.Time) error {
 	return nil
 }
 
+///// Cache methods
+
+func (db *symbolsDB) cacheTUDB(cache *tuSymbolsDBCache, tudb *symbolsTUDB) {
+	cache.tudb = tudb
+	cache.size = tudb.estimateSize()
+	db.memUsed += cache.size
+	db.stats.Loaded++
+}
+
+func (db *symbolsDB) releaseTUDB(cache *tuSymbolsDBCache) error {
+	if cache.dirty {
+		err := cache.tudb.SaveSymbolsTUDB(getDBFileName(cache.Path))
+		if err != nil {
+			return err
+		}
+	}
+	db.forgetTUDB(cache)
+
+	return nil
+}
+
+func (db *symbolsDB) forgetTUDB(cache *tuSymbolsDBCache) {
+	if cache.tudb == nil {
+		return
+	}
+
+	cache.dirty = false
+	cache.tudb = nil
+	db.memUsed -= cache.size
+	db.stats.Loaded--
+	cache.size = 0
+}
+
+func (db *symbolsDB) removeCache(fid fileID) {
+	cache := db.TUDBs[fid]
+	if cache == nil {
+		return
+	}
+
+	db.forgetTUDB(cache)
+	delete(db.TUDBs, fid)
+}
+
+func (db *symbolsDB) dropGlobalIndex() {
+	db.global = nil
+	db.memUsed -= db.globalSize
+	db.globalSize = 0
+}
+
+// evictTUDBs releases the least recently accessed TUDBs, external ones
+// included, until the memory used is under the budget. We evict down to
+// evictLowWater of the budget to not sort the cache on every load. The TUDB
+// keep is never evicted, as it is the one the caller is about to use. The
+// global index is dropped first, as it is only used by dead code requests.
+func (db *symbolsDB) evictTUDBs(keep fileID) {
+	if db.memBudget <= 0 || db.memUsed <= db.memBudget {
+		return
+	}
+
+	db.dropGlobalIndex()
+	if db.memUsed <= db.memBudget {
+		return
+	}
+
+	loaded := []*tuSymbolsDBCache{}
+	for _, caches := range []map[fileID]*tuSymbolsDBCache{db.TUDBs, db.extTUDBs} {
+		for fid, cache := range caches {
+			if cache.tudb != nil && fid != keep {
+				loaded = append(loaded, cache)
+			}
+		}
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].accTime.Before(loaded[j].accTime)
+	})
+
+	lowWater := db.memBudget * evictLowWater / 100
+	for _, cache := range loaded {
+		if db.memUsed <= lowWater {
+			break
+		}
+
+		err := db.releaseTUDB(cache)
+		if err != nil {
+			log.Println("unable to evict", cache.Path, err)
+			continue
+		}
+		db.stats.Evictions++
+	}
+}
+
+func (db *symbolsDB) SetMemBudget(memBudget int64) {
+	db.memBudget = memBudget
+	db.evictTUDBs(fileID{})
+}
+
+func (db *symbolsDB) GetCacheStats() CacheStats {
+	stats := db.stats
+	stats.MemUsed = db.memUsed
+	stats.MemBudget = db.memBudget
+	return stats
+}
+
+// SetExternalIndex sets the index used to look up symbols in system and
+// third-party headers.
+func (db *symbolsDB) SetExternalIndex(ext *externalIndex) {
+	db.ext = ext
+	db.extTUDBs = make(map[fileID]*tuSymbolsDBCache)
+}
+
+// getExternalTUDB returns the TUDB of an external header, or nil if it is not
+// indexed. External TUDBs are cached like the ones of the project, but they
+// are read-only.
+func (db *symbolsDB) getExternalTUDB(fid fileID) *symbolsTUDB {
+	if !db.ext.Enabled() {
+		return nil
+	}
+
+	cache := db.extTUDBs[fid]
+	if cache != nil && cache.tudb != nil {
+		cache.accTime = time.Now()
+		db.stats.Hits++
+		return cache.tudb
+	}
+	db.stats.Misses++
+
+	tudb := db.ext.Get(fid)
+	if tudb == nil {
+		return nil
+	}
+	if cache == nil {
+		cache = &tuSymbolsDBCache{}
+		db.extTUDBs[fid] = cache
+	}
+	cache.Path = tudb.File
+	cache.Hash = tudb.Hash
+	cache.accTime = time.Now()
+	db.cacheTUDB(cache, tudb)
+	db.evictTUDBs(fid)
+
+	return tudb
+}
+
+// forgetExternalTUDBs releases the external TUDBs of the headers of tudb that
+// were indexed again while parsing it.
+func (db *symbolsDB) forgetExternalTUDBs(tudb *symbolsTUDB) {
+	for hid, stamp := range tudb.Headers {
+		cache := db.extTUDBs[hid]
+		if cache != nil && cache.Hash != stamp.Hash {
+			db.forgetTUDB(cache)
+		}
+	}
+}
+
 func getDBFileNameFromSha1(fid fileID) string {
 	return dbDirPath + "/" + hex.EncodeToString(fid[:])
 }
@@ -280,9 +707,12 @@ func (db *symbolsDB) getListOfFilenames(fileSet map[fileID]bool) []string {
 	return filenames
 }
 
+// GetIncluders returns the translation units including the header headPath
+// that were indexed with a different content of the header.
 func (db *symbolsDB) GetIncluders(headPath string) ([]string, error) {
 	realHeader := true
 	hmtime := time.Time{}
+	var hhash *fileHash
 	headID := getStringEncode(headPath)
 
 	if db.TUDBs[headID] == nil {
@@ -316,7 +746,24 @@ func (db *symbolsDB) GetIncluders(headPath string) ([]string, error) {
 			return nil, err
 		}
 
-		if hmtime.IsZero() || hmtime.After(tudb.Headers[headID]) {
+		stamp := tudb.Headers[headID]
+		if hmtime.IsZero() {
+			files = append(files, tudb.File)
+			continue
+		}
+		if hmtime.Equal(stamp.Mtime) {
+			continue
+		}
+
+		// different mtime, check if the content changed
+		if hhash == nil {
+			hash, err := hashFile(headPath)
+			if err != nil {
+				return db.getListOfFilenames(htudb.Includers), nil
+			}
+			hhash = &hash
+		}
+		if *hhash != stamp.Hash {
 			files = append(files, tudb.File)
 		}
 	}
@@ -336,10 +783,22 @@ func (db *symbolsDB) UptodateFile(file string) (bool, bool, error) {
 		return false, false, nil
 	}
 
-	if cache.Mtime.Before(info.ModTime()) {
+	if cache.Mtime.Equal(info.ModTime()) {
+		return true, true, nil
+	}
+
+	// different mtime, check if the content changed
+	hash, err := hashFile(file)
+	if err != nil {
+		return true, false, err
+	}
+	if hash != cache.Hash {
 		return true, false, nil
 	}
 
+	// only touched, avoid hashing it again
+	cache.Mtime = info.ModTime()
+
 	return true, true, nil
 }
 
@@ -353,16 +812,19 @@ func (db *symbolsDB) GetSymbolsTUDB(fid fileID) (*symbolsTUDB, error) {
 	cache.accTime = time.Now()
 
 	if cache.tudb != nil {
+		db.stats.Hits++
 		return cache.tudb, nil
 	}
+	db.stats.Misses++
 
-	var err error
-	cache.tudb, err = db.LoadSymbolsTUDBFromSha1(fid)
+	tudb, err := db.LoadSymbolsTUDBFromSha1(fid)
 	if err != nil {
 		return nil, err
 	}
+	db.cacheTUDB(cache, tudb)
+	db.evictTUDBs(fid)
 
-	return cache.tudb, nil
+	return tudb, nil
 }
 
 func (db *symbolsDB) removeFileFromHeader(headerID, fid fileID) error {
@@ -374,8 +836,11 @@ func (db *symbolsDB) removeFileFromHeader(headerID, fid fileID) error {
 	delete(tudb.Includers, fid)
 	db.TUDBs[headerID].dirty = true
 
-	if len(tudb.Includers) == 0 {
-		delete(db.TUDBs, headerID)
+	if len(tudb.Includers) == 0 && !tudb.Standalone {
+		if !tudb.Mtime.IsZero() {
+			db.orphaned = append(db.orphaned, tudb.File)
+		}
+		db.removeCache(headerID)
 		os.Remove(getDBFileNameFromSha1(headerID))
 	}
 
@@ -384,6 +849,7 @@ func (db *symbolsDB) removeFileFromHeader(headerID, fid fileID) error {
 
 func (db *symbolsDB) RemoveFileReferences(file string) error {
 	fileSha1 := getStringEncode(file)
+	db.dropGlobalIndex()
 
 	tudb, err := db.GetSymbolsTUDB(fileSha1)
 	if err != nil {
@@ -397,12 +863,48 @@ func (db *symbolsDB) RemoveFileReferences(file string) error {
 		}
 	}
 
-	delete(db.TUDBs, fileSha1)
+	db.removeCache(fileSha1)
 	os.Remove(getDBFileName(file))
 
 	return nil
 }
 
+func (db *symbolsDB) GetFileStatus(file string) (*FileStatus, error) {
+	file = filepath.Clean(file)
+	status := &FileStatus{File: file}
+
+	fid := getStringEncode(file)
+	if db.TUDBs[fid] == nil {
+		return status, nil
+	}
+
+	tudb, err := db.GetSymbolsTUDB(fid)
+	if err != nil {
+		return nil, err
+	}
+
+	status.Indexed = true
+	status.Header = len(tudb.Includers) > 0
+	status.Includers = len(tudb.Includers)
+	status.FlagsSource = tudb.FlagsSource
+
+	return status, nil
+}
+
+// IsStandalone checks if file is a header parsed as its own translation unit.
+func (db *symbolsDB) IsStandalone(file string) bool {
+	cache := db.TUDBs[getStringEncode(file)]
+	return cache != nil && cache.Standalone
+}
+
+// TakeOrphanedHeaders returns the headers whose last includer was removed since
+// the last call. They may need to be parsed standalone.
+func (db *symbolsDB) TakeOrphanedHeaders() []string {
+	orphaned := db.orphaned
+	db.orphaned = nil
+	return orphaned
+}
+
 func (db *symbolsDB) GetSetFilesInDB() map[string]bool {
 	fileSet := map[string]bool{}
 
@@ -417,6 +919,39 @@ func (db *symbolsDB) GetSetFilesInDB() map[string]bool {
 	return fileSet
 }
 
+// forEachTUDB calls fn with the TUDB of every file in the DB, sorted by path.
+// The TUDBs not in memory are loaded without caching them, so it can walk
+// large DBs. It stops at the first error.
+func (db *symbolsDB) forEachTUDB(fn func(tudb *symbolsTUDB) error) error {
+	fids := []fileID{}
+	for fid, cache := range db.TUDBs {
+		if !cache.Mtime.IsZero() {
+			fids = append(fids, fid)
+		}
+	}
+	sort.Slice(fids, func(i, j int) bool {
+		return db.TUDBs[fids[i]].Path < db.TUDBs[fids[j]].Path
+	})
+
+	for _, fid := range fids {
+		tudb := db.TUDBs[fid].tudb
+		if tudb == nil {
+			var err error
+			tudb, err = db.LoadSymbolsTUDBFromSha1(fid)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := fn(tudb)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (db *symbolsDB) RemoveFileDepsReferences(file string) ([]string, error) {
 	fileSha1 := getStringEncode(file)
 	tudb, err := db.GetSymbolsTUDB(fileSha1)
@@ -437,12 +972,16 @@ func (db *symbolsDB) InsertTUDB(tudb *symbolsTUDB) error {
 	var err error
 	fileSha1 := getStringEncode(tudb.File)
 	otudb := db.TUDBs[fileSha1]
+	db.dropGlobalIndex()
+	db.forgetExternalTUDBs(tudb)
 
-	if otudb != nil {
-		if otudb.Mtime.After(tudb.Mtime) {
-			log.Panic("Inserting older tudb", otudb.Path, otudb.Mtime, tudb.Mtime)
-		}
+	if otudb != nil && tudb.Standalone && !otudb.Standalone {
+		// an includer showed up while parsing, not needed anymore
+		os.Remove(tudb.tmpFile)
+		return nil
+	}
 
+	if otudb != nil {
 		db.RemoveFileReferences(tudb.File)
 	}
 
@@ -451,14 +990,22 @@ func (db *symbolsDB) InsertTUDB(tudb *symbolsTUDB) error {
 		headerSha1 := getStringEncode(header)
 
 		hcache := db.TUDBs[headerSha1]
+		if hcache != nil && hcache.Standalone {
+			// the header has a real includer now
+			db.RemoveFileReferences(header)
+			hcache = nil
+		}
 		if hcache == nil {
-			htudb = newSymbolsTUDB(header, tudb.Headers[headerSha1])
+			stamp := tudb.Headers[headerSha1]
+			htudb = newSymbolsTUDB(header, stamp.Mtime)
+			htudb.Hash = stamp.Hash
 			hcache = &tuSymbolsDBCache{
-				tudb:    htudb,
 				Mtime:   htudb.Mtime,
+				Hash:    htudb.Hash,
 				Path:    htudb.File,
 				accTime: time.Now(),
 			}
+			db.cacheTUDB(hcache, htudb)
 			db.TUDBs[headerSha1] = hcache
 		} else {
 			htudb, err = db.GetSymbolsTUDB(headerSha1)
@@ -476,8 +1023,10 @@ func (db *symbolsDB) InsertTUDB(tudb *symbolsTUDB) error {
 		return err
 	}
 	db.TUDBs[fileSha1] = &tuSymbolsDBCache{
-		Mtime: tudb.Mtime,
-		Path:  tudb.File,
+		Mtime:      tudb.Mtime,
+		Hash:       tudb.Hash,
+		Path:       tudb.File,
+		Standalone: tudb.Standalone,
 	}
 
 	return nil
@@ -504,9 +1053,10 @@ func (db *symbolsDB) getSymbolLocReq(syms []symbolLoc) []*SymbolLocReq {
 		}
 
 		res = append(res, &SymbolLocReq{
-			cache.Path,
-			int(sym.Line),
-			int(sym.Col),
+			File:     cache.Path,
+			Line:     int(sym.Line),
+			Col:      int(sym.Col),
+			External: db.ext.IsExternal(cache.Path),
 		})
 	}
 
@@ -517,66 +1067,167 @@ func (db *symbolsDB) getSymbolLocReq(syms []symbolLoc) []*SymbolLocReq {
 	return res
 }
 
-func getIncluder(htudb *symbolsTUDB) *symbolsTUDB {
-	for fileSha1 := range htudb.Includers {
-		tudb, err := db.GetSymbolsTUDB(fileSha1)
-		if err != nil {
-			log.Panic("unable to find includer")
+// sortedIncluders returns the includers of a header in the order they should
+// be tried: the context translation unit first, if it is an includer, and then
+// the rest sorted by path to be deterministic.
+func (db *symbolsDB) sortedIncluders(includers map[fileID]bool, context string) []fileID {
+	contextID := getStringEncode(filepath.Clean(context))
+	sorted := []fileID{}
+	for fid := range includers {
+		if db.TUDBs[fid] != nil && (context == "" || fid != contextID) {
+			sorted = append(sorted, fid)
 		}
-		return tudb
 	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return db.TUDBs[sorted[i]].Path < db.TUDBs[sorted[j]].Path
+	})
 
-	return nil
+	if context != "" && includers[contextID] && db.TUDBs[contextID] != nil {
+		sorted = append([]fileID{contextID}, sorted...)
+	}
+
+	return sorted
 }
 
-func (db *symbolsDB) GetSymbolDecl(useReq *SymbolLocReq) ([]*SymbolLocReq, error) {
-	loc := getSymbolLoc(useReq)
+// lookupSymbol returns the translation unit where to look up the location loc
+// and the ID of the symbol there. For header files, it tries the includers
+// (see sortedIncluders) until one has the location.
+func (db *symbolsDB) lookupSymbol(loc *symbolLoc, context string) (*symbolsTUDB, symbolID, error) {
+	// the symbols of indexed external headers are not in their includers
+	if cache := db.TUDBs[loc.File]; cache != nil && db.ext.Enabled() &&
+		db.ext.IsExternal(cache.Path) {
+		if etudb := db.getExternalTUDB(loc.File); etudb != nil {
+			if id, exist := etudb.SymLoc[*loc]; exist {
+				return etudb, id, nil
+			}
+		}
+		return nil, symbolID{}, fmt.Errorf("Symbol use not found")
+	}
+
 	tudb, err := db.GetSymbolsTUDB(loc.File)
 	if err != nil {
-		return nil, err
+		return nil, symbolID{}, err
 	}
 
-	// if header file, we should use any of its tudb
-	if len(tudb.Includers) > 0 {
-		tudb = getIncluder(tudb)
+	if len(tudb.Includers) == 0 {
+		id, exist := tudb.SymLoc[*loc]
+		if !exist {
+			return nil, symbolID{}, fmt.Errorf("Symbol use not found")
+		}
+		return tudb, id, nil
 	}
 
-	// checking if we have the location in DB
-	id, exist := tudb.SymLoc[*loc]
-	if !exist {
-		return nil, fmt.Errorf("Symbol use not found")
+	for _, fid := range db.sortedIncluders(tudb.Includers, context) {
+		itudb, err := db.GetSymbolsTUDB(fid)
+		if err != nil {
+			continue
+		}
+
+		if id, exist := itudb.SymLoc[*loc]; exist {
+			return itudb, id, nil
+		}
 	}
 
+	return nil, symbolID{}, fmt.Errorf("Symbol use not found")
+}
+
+// symbolDataWithExternal returns the data of the symbol id in tudb, adding the
+// declarations and definition in the external headers it includes.
+func (db *symbolsDB) symbolDataWithExternal(tudb *symbolsTUDB, id symbolID) symbolData {
 	data := tudb.SymData[id]
-	return db.getSymbolLocReq(data.Decls), nil
+	if !db.ext.Enabled() {
+		return data
+	}
+
+	// do not modify the slice in the TUDB
+	data.Decls = append([]symbolLoc{}, data.Decls...)
+	for hid := range tudb.Headers {
+		hcache := db.TUDBs[hid]
+		if hcache == nil || !db.ext.IsExternal(hcache.Path) {
+			continue
+		}
+
+		etudb := db.getExternalTUDB(hid)
+		if etudb == nil {
+			continue
+		}
+
+		edata, exist := etudb.SymData[id]
+		if !exist {
+			continue
+		}
+		data.Decls = append(data.Decls, edata.Decls...)
+		if !data.DefAvail && edata.DefAvail {
+			data.DefAvail = true
+			data.Def = edata.Def
+		}
+	}
+
+	return data
 }
 
-func (db *symbolsDB) GetSymbolUses(useReq *SymbolLocReq) ([]*SymbolLocReq, error) {
-	loc := getSymbolLoc(useReq)
-	tudb, err := db.GetSymbolsTUDB(loc.File)
+func (db *symbolsDB) GetSymbolDecl(query *SymbolQuery) ([]*SymbolLocReq, error) {
+	loc := getSymbolLoc(&query.SymbolLocReq)
+	tudb, id, err := db.lookupSymbol(loc, query.Context)
 	if err != nil {
+		if id, exist := db.bundleLookup(&query.SymbolLocReq); exist {
+			return db.bundleDecls(id), nil
+		}
 		return nil, err
 	}
-	fileSha1 := loc.File
 
-	// if header file, we should use any of its tudb
-	if len(tudb.Includers) > 0 {
-		tudb = getIncluder(tudb)
-		fileSha1 = getStringEncode(tudb.File)
+	data := db.symbolDataWithExternal(tudb, id)
+	decls := db.getSymbolLocReq(data.Decls)
+	if decls == nil {
+		decls = db.bundleDecls(id)
 	}
 
-	// checking if we have the location in DB
-	id, exist := tudb.SymLoc[*loc]
-	if !exist {
-		return nil, fmt.Errorf("Symbol use not found")
+	return decls, nil
+}
+
+// accessFilter returns the set of accesses in a comma separated list, or nil
+// if empty.
+func accessFilter(list string) map[string]bool {
+	if list == "" {
+		return nil
 	}
 
-	data := tudb.SymData[id]
+	filter := make(map[string]bool)
+	for _, access := range strings.Split(list, ",") {
+		filter[strings.TrimSpace(access)] = true
+	}
+
+	return filter
+}
+
+func (db *symbolsDB) GetSymbolUses(query *SymbolQuery) ([]*SymbolLocReq, error) {
+	loc := getSymbolLoc(&query.SymbolLocReq)
+	tudb, id, err := db.lookupSymbol(loc, query.Context)
+	if err != nil {
+		if id, exist := db.bundleLookup(&query.SymbolLocReq); exist {
+			// the access of the uses in bundles is unknown
+			if query.AccessFilter != "" {
+				return nil, nil
+			}
+			return db.bundleUses(id), nil
+		}
+		return nil, err
+	}
+	fileSha1 := getStringEncode(tudb.File)
+
+	data := db.symbolDataWithExternal(tudb, id)
+	filter := accessFilter(query.AccessFilter)
 
 	// add uses in this TU
-	uses := make(map[symbolLoc]bool)
-	for _, use := range data.Uses {
-		uses[use.Loc] = true
+	uses := make(map[symbolLoc]string)
+	addUse := func(use *symbolUse) {
+		access := use.accessName()
+		if filter == nil || filter[access] {
+			uses[use.Loc] = access
+		}
+	}
+	for i := range data.Uses {
+		addUse(&data.Uses[i])
 	}
 	// look for uses in declarations in header files
 	for _, decl := range data.Decls {
@@ -589,7 +1240,7 @@ func (db *symbolsDB) GetSymbolUses(useReq *SymbolLocReq) ([]*SymbolLocReq, error
 			continue
 		}
 
-		for tuSha1 := range htudb.Includers {
+		for _, tuSha1 := range db.sortedIncluders(htudb.Includers, query.Context) {
 			if tuSha1 == fileSha1 {
 				continue
 			}
@@ -600,8 +1251,8 @@ func (db *symbolsDB) GetSymbolUses(useReq *SymbolLocReq) ([]*SymbolLocReq, error
 			}
 
 			odata := otudb.SymData[id]
-			for _, use := range odata.Uses {
-				uses[use.Loc] = true
+			for i := range odata.Uses {
+				addUse(&odata.Uses[i])
 			}
 		}
 	}
@@ -610,34 +1261,34 @@ func (db *symbolsDB) GetSymbolUses(useReq *SymbolLocReq) ([]*SymbolLocReq, error
 	for useLoc := range uses {
 		useLocs = append(useLocs, useLoc)
 	}
-
-	return db.getSymbolLocReq(useLocs), nil
-}
-
-func (db *symbolsDB) GetSymbolDef(useReq *SymbolLocReq) (*SymbolLocReq, error) {
-	loc := getSymbolLoc(useReq)
-	tudb, err := db.GetSymbolsTUDB(loc.File)
-	if err != nil {
-		return nil, err
+	res := db.getSymbolLocReq(useLocs)
+	for _, use := range res {
+		use.Access = uses[*getSymbolLoc(use)]
 	}
-	fileSha1 := loc.File
 
-	// if header file, we should use any of its tudb
-	if len(tudb.Includers) > 0 {
-		tudb = getIncluder(tudb)
-		fileSha1 = getStringEncode(tudb.File)
+	// symbols defined in a bundle are also used there, with unknown access
+	if len(db.bundles) > 0 && filter == nil &&
+		db.localSymbolDef(tudb, id, query.Context) == nil {
+		res = append(res, db.bundleUses(id)...)
 	}
-
-	// checking if we have the location in DB
-	id, exist := tudb.SymLoc[*loc]
-	if !exist {
-		return nil, fmt.Errorf("Symbol use not found")
+	if len(res) == 0 {
+		return nil, nil
 	}
 
-	data := tudb.SymData[id]
+	return res, nil
+}
+
+// localSymbolDef returns the definition of the symbol id, looked up from tudb,
+// in the project, or nil if it is not defined there.
+func (db *symbolsDB) localSymbolDef(tudb *symbolsTUDB, id symbolID, context string) *SymbolLocReq {
+	fileSha1 := getStringEncode(tudb.File)
+
+	data := db.symbolDataWithExternal(tudb, id)
 
 	if data.DefAvail {
-		return db.getSymbolLocReq([]symbolLoc{data.Def})[0], nil
+		if def := db.getSymbolLocReq([]symbolLoc{data.Def}); def != nil {
+			return def[0]
+		}
 	}
 
 	for _, decl := range data.Decls {
@@ -650,7 +1301,7 @@ func (db *symbolsDB) GetSymbolDef(useReq *SymbolLocReq) (*SymbolLocReq, error) {
 			continue
 		}
 
-		for tuSha1 := range htudb.Includers {
+		for _, tuSha1 := range db.sortedIncluders(htudb.Includers, context) {
 			if tuSha1 == fileSha1 {
 				continue
 			}
@@ -661,12 +1312,41 @@ func (db *symbolsDB) GetSymbolDef(useReq *SymbolLocReq) (*SymbolLocReq, error) {
 			}
 
 			odata := otudb.SymData[id]
-			if odata.DefAvail {
-				return db.getSymbolLocReq([]symbolLoc{odata.Def})[0], nil
+			if !odata.DefAvail {
+				continue
+			}
+			if def := db.getSymbolLocReq([]symbolLoc{odata.Def}); def != nil {
+				return def[0]
 			}
 		}
 	}
 
+	return nil
+}
+
+func (db *symbolsDB) GetSymbolDef(query *SymbolQuery) (*SymbolLocReq, error) {
+	loc := getSymbolLoc(&query.SymbolLocReq)
+	tudb, id, err := db.lookupSymbol(loc, query.Context)
+	if err != nil {
+		// the definition of an #include line is the included header
+		if itudb, incl := db.includeAt(&query.SymbolLocReq, query.Context); incl != nil {
+			return db.includeTarget(itudb, incl)
+		}
+
+		var exist bool
+		id, exist = db.bundleLookup(&query.SymbolLocReq)
+		if !exist {
+			return nil, err
+		}
+	} else if def := db.localSymbolDef(tudb, id, query.Context); def != nil {
+		return def, nil
+	}
+
+	// not defined in the project, it may be in a bundle
+	if def := db.bundleDef(id); def != nil {
+		return def, nil
+	}
+
 	return nil, fmt.Errorf("Definition not found")
 }
 
@@ -699,13 +1379,31 @@ func newSymbolsTUDB(file string, mtime time.Time) *symbolsTUDB {
 
 		SymLoc:    make(map[symbolLoc]symbolID),
 		SymData:   make(map[symbolID]symbolData),
-		Headers:   make(map[fileID]time.Time),
+		Headers:   make(map[fileID]headerStamp),
 		Includers: make(map[fileID]bool),
 
 		headersTUDB: make(map[string]bool),
 	}
 }
 
+// estimateSize returns an approximation of the memory used by the TUDB. It
+// does not need to be precise, only proportional to the real usage.
+func (db *symbolsTUDB) estimateSize() int64 {
+	size := tudbBaseSize + int64(len(db.File))
+	size += int64(len(db.SymLoc)) * symLocEntrySize
+	for _, data := range db.SymData {
+		size += symDataEntrySize + int64(len(data.Name)+len(data.TypeName)+
+			len(data.TypeCanonical))
+		size += int64(len(data.Uses)) * symUseSize
+		size += int64(len(data.Decls)+len(data.DeclTypes)+len(data.VarDefs)) *
+			symDeclSize
+	}
+	size += int64(len(db.Headers)+len(db.Includers)) * fileEntrySize
+	size += int64(len(db.Funcs)+len(db.Includes)+len(db.FuncStores)) * symDeclSize
+
+	return size
+}
+
 func loadSymbolsTUDB(dbPath string) (*symbolsTUDB, error) {
 	var tudb symbolsTUDB
 
@@ -762,6 +1460,23 @@ func (db *symbolsTUDB) insertSymbolDeclWithDef(sym, def *symbolInfo) {
 
 	data := db.getSymbolData(id, sym.name)
 	data.Decls = append(data.Decls, *symLoc)
+	if sym.kind != "" {
+		data.Kind = sym.kind
+		data.Static = sym.static
+		data.Scope = sym.scope
+	}
+	if sym.typeName != "" {
+		data.TypeName = sym.typeName
+		data.TypeCanonical = sym.typeCanonical
+		data.TypeAvail = sym.typeUSR != ""
+		data.TypeDecl = getStringEncode(sym.typeUSR)
+	}
+	if sym.typ != "" {
+		if data.DeclTypes == nil {
+			data.DeclTypes = make(map[symbolLoc]string)
+		}
+		data.DeclTypes[*symLoc] = sym.typ
+	}
 	if def != nil {
 		data.DefAvail = true
 		data.Def = *getSymbolLoc(&def.loc)
@@ -779,7 +1494,16 @@ func (db *symbolsTUDB) InsertSymbolDeclWithDef(sym, def *symbolInfo) {
 	db.insertSymbolDeclWithDef(sym, def)
 }
 
-func (db *symbolsTUDB) InsertSymbolUse(sym, dec *symbolInfo, funcCall bool) {
+// InsertVarDef marks the declaration of a global variable at sym as a
+// definition.
+func (db *symbolsTUDB) InsertVarDef(sym *symbolInfo) {
+	id := getStringEncode(sym.usr)
+	data := db.getSymbolData(id, sym.name)
+	data.VarDefs = append(data.VarDefs, *getSymbolLoc(&sym.loc))
+	db.SymData[id] = data
+}
+
+func (db *symbolsTUDB) InsertSymbolUse(sym, dec *symbolInfo, funcCall bool, access useAccess) {
 	if dec == nil {
 		log.Println("use without decl, ignoring", sym)
 		return
@@ -804,6 +1528,9 @@ func (db *symbolsTUDB) InsertSymbolUse(sym, dec *symbolInfo, funcCall bool) {
 			lastUse := &data.Uses[len(data.Uses)-1]
 			if lastUse.Loc == *symLoc {
 				lastUse.FuncCall = lastUse.FuncCall || funcCall
+				if access != accessRead {
+					lastUse.Access = access
+				}
 				return
 			}
 		}
@@ -813,24 +1540,50 @@ func (db *symbolsTUDB) InsertSymbolUse(sym, dec *symbolInfo, funcCall bool) {
 	data.Uses = append(data.Uses, symbolUse{
 		Loc:      *symLoc,
 		FuncCall: funcCall,
+		Access:   access,
 	})
 
 	db.SymLoc[*symLoc] = id
 	db.SymData[id] = data
 }
 
-func (db *symbolsTUDB) InsertHeader(inclPath string, headFile clang.File) {
-	var headModTime time.Time
+// InsertFuncRange adds the extent of the function defined at sym, used to find
+// the function enclosing a location.
+func (db *symbolsTUDB) InsertFuncRange(sym *symbolInfo, endLine int) {
+	db.Funcs = append(db.Funcs, funcRange{
+		ID:    getStringEncode(sym.usr),
+		Start: *getSymbolLoc(&sym.loc),
+		End:   int16(endLine),
+	})
+}
+
+// InsertFuncStore adds the store of the function fn, referenced at sym, into
+// the field or variable target.
+func (db *symbolsTUDB) InsertFuncStore(sym, fn, target *symbolInfo) {
+	db.FuncStores = append(db.FuncStores, funcStore{
+		Loc:    *getSymbolLoc(&sym.loc),
+		Func:   getStringEncode(fn.usr),
+		Target: getStringEncode(target.usr),
+	})
+}
+
+// InsertHeader adds the header included by the directive at sym.
+func (db *symbolsTUDB) InsertHeader(sym *symbolInfo, headFile clang.File, stamp headerStamp) {
 	var headPath string
 	if headFile.Name() == "" {
-		headModTime = time.Time{}
-		headPath = nonExistingHeaderName(filepath.Clean(inclPath))
+		headPath = nonExistingHeaderName(filepath.Clean(sym.name))
+		stamp = headerStamp{}
 	} else {
-		headModTime = headFile.Time()
 		headPath = filepath.Clean(headFile.Name())
 	}
-	db.Headers[getStringEncode(headPath)] = headModTime
+	headerSha1 := getStringEncode(headPath)
+	db.Headers[headerSha1] = stamp
 	db.headersTUDB[headPath] = true
+	db.Includes = append(db.Includes, includeRef{
+		Loc:    *getSymbolLoc(&sym.loc),
+		Header: headerSha1,
+		Name:   sym.name,
+	})
 }
 
 func (db *symbolsTUDB) TempSaveDB() error {
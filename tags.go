@@ -0,0 +1,405 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * The symbols DB can be exported as a tags file for the tools that do not talk
+ * to the daemon, either with the tags command:
+ *
+ *   $ navc tags -format ctags -o tags
+ *
+ * or kept updated by the daemon (-tagsFile). There is a tag for every symbol
+ * defined in the project, except local variables and parameters, at the
+ * location of its definition. The formats are:
+ *
+ * - ctags: Universal-ctags compatible, sorted, with the kind letter, the
+ *   enclosing scope (e.g. struct:foo) and file: for static symbols.
+ *
+ * - etags: Emacs TAGS, with a section per file.
+ *
+ * The daemon keeps the tags of every TU in memory (tagsFile), updated when the
+ * TU is inserted in or removed from the DB, and writes the file on the flush
+ * ticks if any TU changed. Tags of symbols in headers are in all their
+ * includers, so they are deduplicated when writing. The tags of the TUs
+ * indexed by previous runs are read from the DB files in the background at
+ * start up (seed), and the file is not written until they are all read.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ctags kind letters of the declaration kinds
+var tagKinds = map[string]byte{
+	"function":   'f',
+	"variable":   'v',
+	"struct":     's',
+	"union":      'u',
+	"enum":       'g',
+	"enumerator": 'e',
+	"member":     'm',
+	"typedef":    't',
+	"macro":      'd',
+}
+
+type tagEntry struct {
+	name   string
+	file   fileID
+	line   int
+	col    int
+	kind   byte
+	scope  string
+	static bool
+}
+
+type tagLine struct {
+	tagEntry
+	path string
+}
+
+type tagsFile struct {
+	path   string
+	format string
+
+	// tags of every TU, and whether the TUs in the DB were read
+	tus    map[fileID][]tagEntry
+	loaded bool
+	dirty  bool
+
+	// tags of the TUs in the DB, read in the background
+	seed chan map[fileID][]tagEntry
+}
+
+// tudbTags returns the tags of the symbols defined in a TUDB.
+func tudbTags(tudb *symbolsTUDB) []tagEntry {
+	tags := []tagEntry{}
+	for _, data := range tudb.SymData {
+		kind, exist := tagKinds[data.Kind]
+		if !exist || data.Name == "" {
+			continue
+		}
+
+		defs := data.VarDefs
+		if data.DefAvail {
+			defs = []symbolLoc{data.Def}
+		}
+		for _, def := range defs {
+			tags = append(tags, tagEntry{
+				name:   data.Name,
+				file:   def.File,
+				line:   int(def.Line),
+				col:    int(def.Col),
+				kind:   kind,
+				scope:  data.Scope,
+				static: data.Static,
+			})
+		}
+	}
+
+	return tags
+}
+
+// resolveTags returns the tags with their file paths, deduplicated and sorted
+// by name, path and line.
+func resolveTags(db *symbolsDB, tags []tagEntry) []tagLine {
+	seen := map[tagEntry]bool{}
+	lines := []tagLine{}
+	for _, tag := range tags {
+		if seen[tag] {
+			continue
+		}
+		seen[tag] = true
+
+		cache := db.TUDBs[tag.file]
+		if cache == nil {
+			continue
+		}
+		lines = append(lines, tagLine{tag, cache.Path})
+	}
+
+	sort.Slice(lines, func(i, j int) bool {
+		a, b := &lines[i], &lines[j]
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		if a.path != b.path {
+			return a.path < b.path
+		}
+		return a.line < b.line
+	})
+
+	return lines
+}
+
+func writeCtags(w io.Writer, lines []tagLine) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "!_TAG_FILE_FORMAT\t2\t/extended format/\n")
+	fmt.Fprintf(bw, "!_TAG_FILE_SORTED\t1\t/0=unsorted, 1=sorted, 2=foldcase/\n")
+	fmt.Fprintf(bw, "!_TAG_PROGRAM_NAME\tnavc\t//\n")
+
+	for _, tag := range lines {
+		fmt.Fprintf(bw, "%s\t%s\t%d;\"\t%c", tag.name, tag.path, tag.line,
+			tag.kind)
+		if tag.scope != "" {
+			fmt.Fprintf(bw, "\t%s", tag.scope)
+		}
+		if tag.static {
+			fmt.Fprintf(bw, "\tfile:")
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+
+	return bw.Flush()
+}
+
+func writeEtags(w io.Writer, lines []tagLine) error {
+	bw := bufio.NewWriter(w)
+
+	files := map[string][]tagLine{}
+	paths := []string{}
+	for _, tag := range lines {
+		if files[tag.path] == nil {
+			paths = append(paths, tag.path)
+		}
+		files[tag.path] = append(files[tag.path], tag)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			// the file is gone, it will be reindexed
+			continue
+		}
+		srcLines := bytes.SplitAfter(content, []byte("\n"))
+		offsets := make([]int, len(srcLines))
+		for i := 1; i < len(srcLines); i++ {
+			offsets[i] = offsets[i-1] + len(srcLines[i-1])
+		}
+
+		tags := files[path]
+		sort.Slice(tags, func(i, j int) bool {
+			return tags[i].line < tags[j].line
+		})
+
+		var section bytes.Buffer
+		for _, tag := range tags {
+			if tag.line < 1 || tag.line > len(srcLines) {
+				continue
+			}
+			// the text of the line up to the end of the name
+			text := strings.TrimRight(string(srcLines[tag.line-1]), "\r\n")
+			end := tag.col - 1 + len(tag.name)
+			if end > 0 && end <= len(text) {
+				text = text[:end]
+			}
+			fmt.Fprintf(&section, "%s\x7f%s\x01%d,%d\n", text, tag.name,
+				tag.line, offsets[tag.line-1])
+		}
+
+		fmt.Fprintf(bw, "\x0c\n%s,%d\n", path, section.Len())
+		bw.Write(section.Bytes())
+	}
+
+	return bw.Flush()
+}
+
+// writeTagsFile writes the tags to path in format, through a temporary file so
+// readers never see it half written.
+func writeTagsFile(path, format string, lines []tagLine) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".navc-tags")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	switch format {
+	case "ctags":
+		err = writeCtags(tmpFile, lines)
+	case "etags":
+		err = writeEtags(tmpFile, lines)
+	default:
+		err = fmt.Errorf("unknown tags format %q", format)
+	}
+	if cerr := tmpFile.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+///// Daemon tags file
+
+// newTagsFile returns the tags file kept updated for db, and starts reading
+// the tags of the TUs already in it. It must be called before db is modified.
+func newTagsFile(path, format string, db *symbolsDB) *tagsFile {
+	tf := &tagsFile{
+		path:   path,
+		format: format,
+		tus:    make(map[fileID][]tagEntry),
+		seed:   make(chan map[fileID][]tagEntry, 1),
+	}
+
+	fids := []fileID{}
+	for fid, cache := range db.TUDBs {
+		if !cache.Mtime.IsZero() {
+			fids = append(fids, fid)
+		}
+	}
+
+	// only the DB files are read, the DB is not safe for concurrent use
+	go func() {
+		seeded := make(map[fileID][]tagEntry)
+		for _, fid := range fids {
+			tudb, err := loadSymbolsTUDB(getDBFileNameFromSha1(fid))
+			if err != nil {
+				// e.g. being saved, as it was indexed again
+				continue
+			}
+			seeded[fid] = tudbTags(tudb)
+		}
+		tf.seed <- seeded
+	}()
+
+	return tf
+}
+
+// addSeed adds the tags read in the background, if done or wait is true. The
+// TUs updated meanwhile are not replaced. It returns false if not done.
+func (tf *tagsFile) addSeed(wait bool) bool {
+	if tf.loaded {
+		return true
+	}
+
+	var seeded map[fileID][]tagEntry
+	if wait {
+		seeded = <-tf.seed
+	} else {
+		select {
+		case seeded = <-tf.seed:
+		default:
+			return false
+		}
+	}
+
+	for fid, tuTags := range seeded {
+		if _, exist := tf.tus[fid]; !exist {
+			tf.tus[fid] = tuTags
+		}
+	}
+	tf.loaded = true
+	tf.dirty = true
+
+	return true
+}
+
+// Update replaces the tags of a TU just inserted in the DB.
+func (tf *tagsFile) Update(tudb *symbolsTUDB) {
+	if tf == nil {
+		return
+	}
+
+	tf.tus[getStringEncode(tudb.File)] = tudbTags(tudb)
+	tf.dirty = true
+}
+
+// Remove drops the tags of a TU removed from the DB.
+func (tf *tagsFile) Remove(fid fileID) {
+	if tf == nil {
+		return
+	}
+
+	delete(tf.tus, fid)
+	tf.dirty = true
+}
+
+// Write writes the tags file if any TU changed since the last write. TUs no
+// longer in the DB are dropped. Until the tags of the TUs indexed by previous
+// runs are read, the file is written only if wait is true, e.g. on exit.
+func (tf *tagsFile) Write(db *symbolsDB, wait bool) error {
+	if tf == nil {
+		return nil
+	}
+
+	if !tf.addSeed(wait) || !tf.dirty {
+		return nil
+	}
+
+	entries := []tagEntry{}
+	for fid, tuTags := range tf.tus {
+		if db.TUDBs[fid] == nil {
+			delete(tf.tus, fid)
+			continue
+		}
+		entries = append(entries, tuTags...)
+	}
+
+	err := writeTagsFile(tf.path, tf.format, resolveTags(db, entries))
+	if err != nil {
+		return err
+	}
+	tf.dirty = false
+
+	return nil
+}
+
+///// tags command
+
+// tagsCmd is the tags command, it writes the tags file of a DB.
+func tagsCmd(args []string) error {
+	fs := flag.NewFlagSet("tags", flag.ExitOnError)
+	dbDir := fs.String("db", defaultConfig().DB, "Path to symbols DB dir")
+	format := fs.String("format", "ctags", "Tags format: ctags or etags")
+	out := fs.String("o", "", "Path of the tags file (default tags or TAGS)")
+	fs.Parse(args)
+
+	if *out == "" {
+		*out = "tags"
+		if *format == "etags" {
+			*out = "TAGS"
+		}
+	}
+
+	db, err := openSymbolsDB(*dbDir)
+	if err != nil {
+		return err
+	}
+
+	entries := []tagEntry{}
+	err = db.forEachTUDB(func(tudb *symbolsTUDB) error {
+		entries = append(entries, tudbTags(tudb)...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeTagsFile(*out, *format, resolveTags(db, entries))
+}
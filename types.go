@@ -0,0 +1,177 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * Type queries. Every variable, field, parameter, function and typedef has its
+ * declared type (for functions, the result type; for typedefs, the underlying
+ * one), its canonical type and the symbol declaring its base type, i.e. the
+ * type without pointers and arrays (TypeDecl). With typedef chains like:
+ *
+ *   typedef struct foo_s foo_t;
+ *   typedef foo_t *foo_handle;
+ *   foo_handle h;
+ *
+ * the type of h is resolved following TypeDecl from typedef to typedef
+ * (foo_handle, foo_t) until a struct, union or enum (struct foo_s), or a
+ * typedef of a builtin type. All the declarations involved are in the TUDB of
+ * the symbol, as they are needed to parse it, or in the external headers it
+ * includes (e.g. uint32_t or FILE) if they are indexed.
+ *
+ * - GetTypeInfo: the declared and canonical types and the typedef chain.
+ * - GetTypeDef: the definition of the struct, union or enum at the end of the
+ *   chain (go to type definition), or the last typedef.
+ */
+
+import (
+	"fmt"
+)
+
+// TypeStep is a typedef of a chain: Name is defined as Type at Loc.
+type TypeStep struct {
+	Name string
+	Type string
+	Loc  *SymbolLocReq
+}
+
+// TypeInfo is the type of a symbol. Type is the declared type (the underlying
+// one for typedefs), or empty for structs, unions and enums, whose Definition
+// is their own.
+type TypeInfo struct {
+	Name       string
+	Type       string
+	Canonical  string
+	Typedefs   []TypeStep
+	Definition *SymbolLocReq
+}
+
+// maximum typedefs followed, in case of inconsistent DBs
+const maxTypedefChain int = 64
+
+// symbolTypeDecl returns the declaration location of a symbol: its definition
+// or its first declaration.
+func (db *symbolsDB) symbolTypeDecl(tudb *symbolsTUDB, id symbolID, context string) *SymbolLocReq {
+	if def := db.localSymbolDef(tudb, id, context); def != nil {
+		return def
+	}
+
+	data := db.symbolDataWithExternal(tudb, id)
+	if decls := db.getSymbolLocReq(data.Decls); len(decls) > 0 {
+		return decls[0]
+	}
+
+	return nil
+}
+
+// declaredSymbolData returns the data of the symbol id declared in tudb or in
+// the external headers it includes, whose symbols are not in tudb.
+func (db *symbolsDB) declaredSymbolData(tudb *symbolsTUDB, id symbolID) (symbolData, bool) {
+	if data, exist := tudb.SymData[id]; exist && data.Kind != "" {
+		return data, true
+	}
+	if !db.ext.Enabled() {
+		return symbolData{}, false
+	}
+
+	for hid := range tudb.Headers {
+		hcache := db.TUDBs[hid]
+		if hcache == nil || !db.ext.IsExternal(hcache.Path) {
+			continue
+		}
+
+		etudb := db.getExternalTUDB(hid)
+		if etudb == nil {
+			continue
+		}
+		if data, exist := etudb.SymData[id]; exist && data.Kind != "" {
+			return data, true
+		}
+	}
+
+	return symbolData{}, false
+}
+
+// GetTypeInfo returns the type of the symbol at the location.
+func (db *symbolsDB) GetTypeInfo(query *SymbolQuery) (*TypeInfo, error) {
+	loc := getSymbolLoc(&query.SymbolLocReq)
+	tudb, id, err := db.lookupSymbol(loc, query.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	data := tudb.SymData[id]
+	info := &TypeInfo{
+		Name:      data.Name,
+		Type:      data.TypeName,
+		Canonical: data.TypeCanonical,
+		Typedefs:  []TypeStep{},
+	}
+
+	cur, avail := data.TypeDecl, data.TypeAvail
+	switch data.Kind {
+	case "struct", "union", "enum":
+		info.Canonical = data.Kind + " " + data.Name
+		info.Definition = db.symbolTypeDecl(tudb, id, query.Context)
+		return info, nil
+	case "typedef":
+		cur, avail = id, true
+	case "":
+		return nil, fmt.Errorf("Symbol has no type")
+	}
+
+	for i := 0; avail && i < maxTypedefChain; i++ {
+		tdata, exist := db.declaredSymbolData(tudb, cur)
+		if !exist {
+			break
+		}
+
+		loc := db.symbolTypeDecl(tudb, cur, query.Context)
+		if tdata.Kind != "typedef" {
+			info.Definition = loc
+			break
+		}
+		info.Typedefs = append(info.Typedefs, TypeStep{
+			Name: tdata.Name,
+			Type: tdata.TypeName,
+			Loc:  loc,
+		})
+		if info.Canonical == "" {
+			info.Canonical = tdata.TypeCanonical
+		}
+		cur, avail = tdata.TypeDecl, tdata.TypeAvail
+	}
+
+	return info, nil
+}
+
+// GetTypeDef returns the definition of the type of the symbol at the location,
+// going through typedefs.
+func (db *symbolsDB) GetTypeDef(query *SymbolQuery) (*SymbolLocReq, error) {
+	info, err := db.GetTypeInfo(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Definition != nil {
+		return info.Definition, nil
+	}
+	if n := len(info.Typedefs); n > 0 && info.Typedefs[n-1].Loc != nil {
+		return info.Typedefs[n-1].Loc, nil
+	}
+
+	return nil, fmt.Errorf("Type definition not found")
+}
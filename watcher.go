@@ -0,0 +1,467 @@
+/*
+ * Copyright 2015 Google Inc. All Rights Reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+/*
+ * This module watches the indexed directories for changes. The files handler
+ * (files.go) only sees the fileWatcher interface, and every backend reports
+ * changes as fsnotify events. There are several backends:
+ *
+ * - fsnotify: one watch per directory. This is exact and cheap, but every
+ *   directory counts as an open file on mac and inotify has a limit of watches
+ *   per user. Large trees like the Linux kernel hit these limits.
+ *
+ * - poll: scans the directories every pollInterval. The entries of a directory
+ *   are read again only if the directory mtime changed (a file was created,
+ *   removed or renamed). Otherwise, only the known files are stat'ed to find
+ *   writes. It does not use any descriptor.
+ *
+ * - hybrid: polls all the directories, and watches with fsnotify only the
+ *   directories with recent changes (hot directories), up to maxHotDirs.
+ *
+ * - auto (default): fsnotify, but any directory that cannot be watched because
+ *   of inotify or descriptor limits is polled instead. If fsnotify cannot be
+ *   used at all, every directory is polled.
+ *
+ * In hybrid mode, hot directories are still polled to keep their stamps, but
+ * their poll events are dropped, as fsnotify reports them.
+ */
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	fsnotify "gopkg.in/fsnotify.v1"
+)
+
+// maximum number of directories watched with fsnotify in hybrid mode
+const maxHotDirs int = 256
+
+type fileWatcher interface {
+	Add(path string) error
+	Remove(path string) error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+func newFileWatcher(kind string, pollInterval time.Duration) (fileWatcher, error) {
+	switch kind {
+	case "fsnotify":
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			return nil, err
+		}
+		return &notifyWatcher{w}, nil
+	case "poll":
+		return newPollWatcher(pollInterval), nil
+	case "hybrid", "auto":
+		w, err := fsnotify.NewWatcher()
+		if err != nil {
+			if kind == "hybrid" {
+				return nil, err
+			}
+			// e.g. the limit of inotify instances
+			log.Println("unable to use fsnotify", err, "falling back to polling")
+			return newPollWatcher(pollInterval), nil
+		}
+		return newComboWatcher(&notifyWatcher{w}, kind == "hybrid",
+			pollInterval), nil
+	}
+
+	return nil, fmt.Errorf("unknown watcher %q", kind)
+}
+
+// isWatchLimitErr returns true if the error is caused by the inotify watches
+// limit or the descriptors limit.
+func isWatchLimitErr(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) ||
+		errors.Is(err, syscall.EMFILE) ||
+		errors.Is(err, syscall.ENFILE)
+}
+
+///// fsnotify watcher
+
+type notifyWatcher struct {
+	w *fsnotify.Watcher
+}
+
+func (nw *notifyWatcher) Add(path string) error {
+	return nw.w.Add(path)
+}
+
+func (nw *notifyWatcher) Remove(path string) error {
+	return nw.w.Remove(path)
+}
+
+func (nw *notifyWatcher) Events() <-chan fsnotify.Event {
+	return nw.w.Events
+}
+
+func (nw *notifyWatcher) Errors() <-chan error {
+	return nw.w.Errors
+}
+
+func (nw *notifyWatcher) Close() error {
+	return nw.w.Close()
+}
+
+///// Polling watcher
+
+type fileStamp struct {
+	mtime time.Time
+	size  int64
+	dir   bool
+}
+
+type polledDir struct {
+	mtime time.Time
+	files map[string]fileStamp
+}
+
+type pollWatcher struct {
+	mu       sync.Mutex
+	dirs     map[string]*polledDir
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan bool
+	interval time.Duration
+}
+
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	pw := &pollWatcher{
+		dirs:     make(map[string]*polledDir),
+		events:   make(chan fsnotify.Event, 128),
+		errors:   make(chan error),
+		done:     make(chan bool),
+		interval: interval,
+	}
+
+	go pw.loop()
+
+	return pw
+}
+
+func readDirStamps(path string) (*polledDir, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pd := &polledDir{info.ModTime(), make(map[string]fileStamp)}
+	for _, entry := range entries {
+		pd.files[entry.Name()] = fileStamp{
+			entry.ModTime(),
+			entry.Size(),
+			entry.IsDir(),
+		}
+	}
+
+	return pd, nil
+}
+
+func (pw *pollWatcher) Add(path string) error {
+	pd, err := readDirStamps(path)
+	if err != nil {
+		return err
+	}
+
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	pw.dirs[path] = pd
+
+	return nil
+}
+
+func (pw *pollWatcher) Remove(path string) error {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	delete(pw.dirs, path)
+
+	return nil
+}
+
+func (pw *pollWatcher) Events() <-chan fsnotify.Event {
+	return pw.events
+}
+
+func (pw *pollWatcher) Errors() <-chan error {
+	return pw.errors
+}
+
+func (pw *pollWatcher) Close() error {
+	close(pw.done)
+	return nil
+}
+
+// scanDir returns the changes in directory path since the last scan.
+func scanDir(path string, pd *polledDir) ([]fsnotify.Event, *polledDir) {
+	events := []fsnotify.Event{}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		return events, nil
+	}
+
+	if info.ModTime().Equal(pd.mtime) {
+		// same entries, look only for writes
+		for name, stamp := range pd.files {
+			if stamp.dir {
+				continue
+			}
+
+			filePath := filepath.Join(path, name)
+			finfo, err := os.Stat(filePath)
+			if err != nil {
+				// it will be reported when the dir mtime changes
+				continue
+			}
+			if !finfo.ModTime().Equal(stamp.mtime) || finfo.Size() != stamp.size {
+				pd.files[name] = fileStamp{finfo.ModTime(), finfo.Size(), false}
+				events = append(events, fsnotify.Event{Name: filePath, Op: fsnotify.Write})
+			}
+		}
+		return events, pd
+	}
+
+	npd, err := readDirStamps(path)
+	if err != nil {
+		events = append(events, fsnotify.Event{Name: path, Op: fsnotify.Remove})
+		return events, nil
+	}
+
+	for name, stamp := range npd.files {
+		filePath := filepath.Join(path, name)
+		old, exist := pd.files[name]
+		switch {
+		case !exist:
+			events = append(events, fsnotify.Event{Name: filePath, Op: fsnotify.Create})
+		case stamp.dir:
+			// changes inside are found by scanning the dir itself
+		case !stamp.mtime.Equal(old.mtime) || stamp.size != old.size:
+			events = append(events, fsnotify.Event{Name: filePath, Op: fsnotify.Write})
+		}
+	}
+	for name := range pd.files {
+		if _, exist := npd.files[name]; !exist {
+			filePath := filepath.Join(path, name)
+			events = append(events, fsnotify.Event{Name: filePath, Op: fsnotify.Remove})
+		}
+	}
+
+	return events, npd
+}
+
+func (pw *pollWatcher) scan() []fsnotify.Event {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+
+	events := []fsnotify.Event{}
+	for path, pd := range pw.dirs {
+		dirEvents, npd := scanDir(path, pd)
+		if npd == nil {
+			delete(pw.dirs, path)
+		} else {
+			pw.dirs[path] = npd
+		}
+		events = append(events, dirEvents...)
+	}
+
+	return events
+}
+
+func (pw *pollWatcher) loop() {
+	tick := time.NewTicker(pw.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-pw.done:
+			return
+		case <-tick.C:
+		}
+
+		// send without the lock, the receiver may be adding dirs
+		for _, event := range pw.scan() {
+			select {
+			case pw.events <- event:
+			case <-pw.done:
+				return
+			}
+		}
+	}
+}
+
+///// Hybrid and auto watcher
+
+type comboWatcher struct {
+	mu     sync.Mutex
+	notify fileWatcher
+	poll   *pollWatcher
+
+	// hybrid mode: directories watched by notify, most recent first
+	hybrid  bool
+	hot     *list.List
+	hotElem map[string]*list.Element
+
+	// auto mode: we already warned about the fallback
+	warned bool
+
+	events chan fsnotify.Event
+	errors chan error
+	done   chan bool
+}
+
+// newComboWatcher returns a hybrid or auto watcher using notify, normally an
+// fsnotify watcher, for the directories not polled.
+func newComboWatcher(notify fileWatcher, hybrid bool, pollInterval time.Duration) *comboWatcher {
+	cw := &comboWatcher{
+		notify:  notify,
+		poll:    newPollWatcher(pollInterval),
+		hybrid:  hybrid,
+		hot:     list.New(),
+		hotElem: make(map[string]*list.Element),
+		events:  make(chan fsnotify.Event),
+		errors:  make(chan error),
+		done:    make(chan bool),
+	}
+
+	go cw.forward(notify.Events(), notify.Errors(), false)
+	go cw.forward(cw.poll.events, cw.poll.errors, hybrid)
+
+	return cw
+}
+
+func (cw *comboWatcher) forward(events <-chan fsnotify.Event, errs <-chan error, promote bool) {
+	for {
+		select {
+		case <-cw.done:
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if promote && cw.promote(filepath.Dir(event.Name)) {
+				// already reported by notify
+				continue
+			}
+			select {
+			case cw.events <- event:
+			case <-cw.done:
+				return
+			}
+		case err, ok := <-errs:
+			if !ok {
+				return
+			}
+			select {
+			case cw.errors <- err:
+			case <-cw.done:
+				return
+			}
+		}
+	}
+}
+
+// promote watches a directory with recent changes with fsnotify, and returns
+// true if it was already watched. The least recently changed directory is
+// demoted if there are too many.
+func (cw *comboWatcher) promote(path string) bool {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+
+	if elem := cw.hotElem[path]; elem != nil {
+		cw.hot.MoveToFront(elem)
+		return true
+	}
+
+	if cw.notify.Add(path) != nil {
+		return false
+	}
+	cw.hotElem[path] = cw.hot.PushFront(path)
+
+	if cw.hot.Len() > maxHotDirs {
+		last := cw.hot.Back()
+		cw.hot.Remove(last)
+		delete(cw.hotElem, last.Value.(string))
+		cw.notify.Remove(last.Value.(string))
+	}
+
+	return false
+}
+
+func (cw *comboWatcher) Add(path string) error {
+	if cw.hybrid {
+		return cw.poll.Add(path)
+	}
+
+	err := cw.notify.Add(path)
+	if !isWatchLimitErr(err) {
+		return err
+	}
+
+	cw.mu.Lock()
+	if !cw.warned {
+		log.Println("unable to watch", path, err, "falling back to polling")
+		cw.warned = true
+	}
+	cw.mu.Unlock()
+
+	return cw.poll.Add(path)
+}
+
+func (cw *comboWatcher) Remove(path string) error {
+	cw.mu.Lock()
+	if elem := cw.hotElem[path]; elem != nil {
+		cw.hot.Remove(elem)
+		delete(cw.hotElem, path)
+	}
+	cw.mu.Unlock()
+
+	cw.notify.Remove(path)
+	return cw.poll.Remove(path)
+}
+
+func (cw *comboWatcher) Events() <-chan fsnotify.Event {
+	return cw.events
+}
+
+func (cw *comboWatcher) Errors() <-chan error {
+	return cw.errors
+}
+
+func (cw *comboWatcher) Close() error {
+	close(cw.done)
+	cw.poll.Close()
+	return cw.notify.Close()
+}